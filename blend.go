@@ -0,0 +1,334 @@
+package fate
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+)
+
+// Blend replies with several models at once, as if they were one. Each
+// step of a reply chooses among everything the models have seen
+// following (or preceding) its context, and each model's choices are
+// weighted by its share of the blend: a word a model would choose half
+// the time, in a model weighted 3 of 4, is chosen 3/8 of the time when
+// the other model hasn't seen it. Models that haven't seen the context
+// at all are left out.
+//
+// The models' words are looked up in a dictionary of the blend's own,
+// so a word means the same thing in every model, and the blend's
+// Stemmer decides which words are synonyms. The models can go on
+// learning; the blend sees everything they've learned each time it
+// replies.
+type Blend struct {
+	m *Model
+}
+
+// Blended is a model in a Blend, with its weight.
+type Blended struct {
+	Model  *Model
+	Weight float64
+}
+
+// NewBlend returns a Blend of models. The blend uses the lowest order
+// of its models, and opts for everything else: only opts' Stemmer, Rand,
+// MaxPath, Backoff, Tokenizer and Detokenizer apply. Weights must be
+// positive, and each model can only be in the blend once.
+func NewBlend(opts Config, models ...Blended) (*Blend, error) {
+	if len(models) == 0 {
+		return nil, errors.New("fate: blend has no models")
+	}
+
+	b := &blendChains{}
+
+	order, total := MaxOrder, 0.0
+	for i, bm := range models {
+		if bm.Weight <= 0 {
+			return nil, errors.New("fate: blend weights must be positive")
+		}
+
+		// Replies read lock every model once.
+		for _, prev := range models[:i] {
+			if prev.Model == bm.Model {
+				return nil, errors.New("fate: blend has a model twice")
+			}
+		}
+
+		if bm.Model.order < order {
+			order = bm.Model.order
+		}
+		total += bm.Weight
+
+		b.models = append(b.models, bm.Model)
+		b.weights = append(b.weights, bm.Weight)
+	}
+
+	// Blends sharing models must lock them in the same order, or a
+	// waiting Learn could leave each blend holding a lock the other
+	// needs.
+	b.locking = append([]*Model(nil), b.models...)
+	sort.Slice(b.locking, func(i, j int) bool { return b.locking[i].id < b.locking[j].id })
+
+	for i := range b.weights {
+		b.weights[i] /= total
+	}
+
+	b.toShared = make([][]token, len(models))
+	b.fromShared = make([][]token, len(models))
+
+	b.tokens = newSyndict(opts.stemmerOrDefault())
+
+	return &Blend{m: &Model{
+		tokens:   b.tokens,
+		startTok: b.tokens.ID("<S>"),
+		endTok:   b.tokens.ID("</S>"),
+
+		hi:      make([]ngrams, order-3),
+		order:   order,
+		backoff: opts.backoffOrDefault(),
+
+		weighted: true,
+		maxPath:  opts.maxPathOrDefault(),
+
+		tokenizer:   opts.tokenizerOrDefault(),
+		detokenizer: opts.detokenizerOrDefault(),
+
+		chains: b,
+
+		rand:  &prng{uint64(opts.randOrDefault().Int63())},
+		count: &counters{},
+	}}, nil
+}
+
+// Reply is Model.Reply.
+func (b *Blend) Reply(text string) string {
+	return b.m.Reply(text)
+}
+
+// ReplyErr is Model.ReplyErr.
+func (b *Blend) ReplyErr(text string) (string, error) {
+	return b.m.ReplyErr(text)
+}
+
+// ReplyContext is Model.ReplyContext.
+func (b *Blend) ReplyContext(ctx context.Context, text string) (string, error) {
+	return b.m.ReplyContext(ctx, text)
+}
+
+// ReplyWith is Model.ReplyWith.
+func (b *Blend) ReplyWith(ctx context.Context, text string, opts ReplyOptions) (string, error) {
+	return b.m.ReplyWith(ctx, text, opts)
+}
+
+// ReplyCandidate is Model.ReplyCandidate.
+func (b *Blend) ReplyCandidate(ctx context.Context, text string, opts ReplyOptions) (*Candidate, error) {
+	return b.m.ReplyCandidate(ctx, text, opts)
+}
+
+// ReplyStream is Model.ReplyStream. fn is called with every blended
+// model's read lock held, so learning in any of them waits until it
+// returns.
+func (b *Blend) ReplyStream(ctx context.Context, text string, fn func(word string) error) (string, error) {
+	return b.m.ReplyStream(ctx, text, fn)
+}
+
+// noToken marks a word a blended model doesn't know.
+const noToken = ^token(0)
+
+// blendScale is what the chances of a blend's successors are
+// multiplied by to count them.
+const blendScale = 1 << 16
+
+// blendChains holds the models of a Blend.
+type blendChains struct {
+	models  []*Model
+	weights []float64
+
+	// locking is models in the order they're locked.
+	locking []*Model
+
+	// lock guards the blend's dictionary, tokens, and the maps
+	// between it and the models', which grow as the models learn.
+	// toShared[i] takes model i's tokens to the blend's, and
+	// fromShared[i] takes them back. Words a model doesn't know
+	// are noToken.
+	lock       sync.RWMutex
+	tokens     *syndict
+	toShared   [][]token
+	fromShared [][]token
+}
+
+// rlock read locks every model, and the blend's dictionary after
+// adding the words they've learned since the last reply.
+func (b *blendChains) rlock() {
+	for _, m := range b.locking {
+		m.chains.rlock()
+	}
+
+	b.lock.Lock()
+	b.sync()
+	b.lock.Unlock()
+
+	// Another reply may sync before this one gets the read lock,
+	// but syncing only adds words.
+	b.lock.RLock()
+}
+
+func (b *blendChains) runlock() {
+	b.lock.RUnlock()
+
+	for _, m := range b.locking {
+		m.chains.runlock()
+	}
+}
+
+// sync adds the words the models have learned to the dictionary.
+func (b *blendChains) sync() {
+	synced := make([]int, len(b.models))
+	for i, m := range b.models {
+		synced[i] = len(b.toShared[i])
+		for tok := synced[i]; tok < m.tokens.Len(); tok++ {
+			shared := noToken
+			if word := m.tokens.Word(token(tok)); word != "" {
+				shared = b.tokens.ID(word)
+			}
+
+			b.toShared[i] = append(b.toShared[i], shared)
+		}
+	}
+
+	n := b.tokens.Len()
+	for i := range b.models {
+		for len(b.fromShared[i]) < n {
+			b.fromShared[i] = append(b.fromShared[i], noToken)
+		}
+
+		// A word forgotten and learned again has a new token.
+		for tok := synced[i]; tok < len(b.toShared[i]); tok++ {
+			if shared := b.toShared[i][tok]; shared != noToken {
+				b.fromShared[i][shared] = token(tok)
+			}
+		}
+	}
+}
+
+// from returns model i's token for tok, or noToken.
+func (b *blendChains) from(i int, tok token) token {
+	if int(tok) >= len(b.fromShared[i]) {
+		return noToken
+	}
+
+	return b.fromShared[i][tok]
+}
+
+func (b *blendChains) empty() bool {
+	for _, m := range b.models {
+		if !m.chains.empty() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// context returns the tokens seen following ctx, a context of length
+// k, or preceding it if rev is set, in every model that has seen it.
+func (b *blendChains) context(k int, ctx ngram, rev bool) (tokset, bool) {
+	var set blendSet
+	found := false
+
+	for i, m := range b.models {
+		mctx, ok := b.fromContext(i, k, ctx)
+		if !ok {
+			continue
+		}
+
+		toks, ok := m.chains.context(k, mctx, rev)
+		if !ok {
+			continue
+		}
+
+		found = true
+		set.add(b, i, &toks)
+	}
+
+	if !found {
+		return tokset{}, false
+	}
+
+	return set.tokset(), true
+}
+
+// fromContext returns model i's tokens for ctx, a context of length
+// k, or false if the model doesn't know one of them.
+func (b *blendChains) fromContext(i, k int, ctx ngram) (ngram, bool) {
+	var ret ngram
+	for j := 0; j < k; j++ {
+		if ret[j] = b.from(i, ctx[j]); ret[j] == noToken {
+			return ngram{}, false
+		}
+	}
+
+	return ret, true
+}
+
+// nextSet returns the tokens seen following tok in any model.
+func (b *blendChains) nextSet(tok token) tokset {
+	var next blendSet
+	for i, m := range b.models {
+		if mtok := b.from(i, tok); mtok != noToken {
+			set := m.chains.nextSet(mtok)
+			next.add(b, i, &set)
+		}
+	}
+
+	return next.tokset()
+}
+
+// blendSet collects the successors of a context from a blend's models,
+// with the chance of each.
+type blendSet []blendTok
+
+type blendTok struct {
+	tok    token
+	chance float64
+}
+
+// add adds the tokens of set, from model i.
+func (s *blendSet) add(b *blendChains, i int, set *tokset) {
+	total := float64(set.Total())
+	for j, tok := range set.Tokens() {
+		shared := b.toShared[i][tok]
+		if shared == noToken {
+			continue
+		}
+
+		*s = append(*s, blendTok{shared, b.weights[i] * float64(set.Count(j)) / total})
+	}
+}
+
+// tokset returns a counted set of s's tokens, with their chances
+// summed across models.
+func (s blendSet) tokset() tokset {
+	sort.Slice(s, func(i, j int) bool { return s[i].tok < s[j].tok })
+
+	toks := make([]token, 0, len(s))
+	counts := make([]int, 0, len(s))
+	for i := 0; i < len(s); {
+		tok, chance := s[i].tok, 0.0
+		for ; i < len(s) && s[i].tok == tok; i++ {
+			chance += s[i].chance
+		}
+
+		// Everything seen stays possible, however unlikely.
+		n := int(chance*blendScale + 0.5)
+		if n < 1 {
+			n = 1
+		}
+
+		toks = append(toks, tok)
+		counts = append(counts, n)
+	}
+
+	return countedTokset(toks, counts)
+}
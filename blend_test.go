@@ -0,0 +1,170 @@
+package fate
+
+import (
+	"context"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestBlend(t *testing.T) {
+	a := NewModel(Config{})
+	a.Learn("i like cats")
+	a.Learn("a b c d")
+
+	b := NewModel(Config{Order: 4, Weighted: true})
+	b.Learn("i like dogs")
+	b.Learn("c d e f")
+
+	blend, err := NewBlend(Config{}, Blended{a, 3}, Blended{b, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]int)
+	for i := 0; i < 4000; i++ {
+		opts := ReplyOptions{Rand: rand.NewSource(int64(i))}
+		reply, err := blend.ReplyWith(context.Background(), "i", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[reply]++
+	}
+
+	if len(seen) != 2 {
+		t.Fatalf("Reply(i) => %v, want i like cats and i like dogs", seen)
+	}
+
+	// cats is three times as likely as dogs.
+	if cats := float64(seen["i like cats"]) / 4000; cats < 0.7 || cats > 0.8 {
+		t.Errorf("Reply(i) => %v, want i like cats 75%% of the time", seen)
+	}
+
+	// Replies can go from one model's chains to the other's.
+	crossed := false
+	for i := 0; i < 100; i++ {
+		opts := ReplyOptions{Rand: rand.NewSource(int64(i))}
+		reply, err := blend.ReplyWith(context.Background(), "a", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		crossed = crossed || reply == "a b c d e f"
+	}
+
+	if !crossed {
+		t.Errorf("Reply(a) never followed c d into the other model")
+	}
+}
+
+func TestBlendStemmer(t *testing.T) {
+	a := NewModel(Config{Stemmer: exact{}})
+	a.Learn("Hello there")
+
+	b := NewModel(Config{Stemmer: exact{}})
+	b.Learn("hello world")
+
+	blend, err := NewBlend(Config{}, Blended{a, 1}, Blended{b, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		seen[blend.Reply("HELLO")] = true
+	}
+
+	if !seen["Hello there"] || !seen["hello world"] || len(seen) != 2 {
+		t.Errorf("Reply(HELLO) => %v, want Hello there and hello world", seen)
+	}
+}
+
+func TestBlendLearning(t *testing.T) {
+	rand.Seed(0)
+	words := vocab(100)
+	sentences := corpus(words, 2000, func() int {
+		return 2 + rand.Intn(8)
+	})
+
+	known := make(map[string]bool)
+	for _, word := range words {
+		known[word] = true
+	}
+
+	a := NewModel(Config{})
+	b := NewModel(Config{Weighted: true})
+
+	blend, err := NewBlend(Config{}, Blended{a, 1}, Blended{b, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reply, err := blend.ReplyErr("hello"); reply != "" || err != nil {
+		t.Errorf("empty blend Reply() => %q, %v", reply, err)
+	}
+
+	var wg sync.WaitGroup
+	for _, m := range []*Model{a, b} {
+		wg.Add(1)
+		go func(m *Model) {
+			defer wg.Done()
+			for i, sen := range sentences {
+				m.Learn(sen)
+
+				// Forgotten words come back with new tokens.
+				if m.weighted && i%2 == 0 {
+					m.Forget(sen)
+				}
+			}
+		}(m)
+	}
+
+	for i := 0; i < 500; i++ {
+		reply, err := blend.ReplyErr(strchoice(words))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, word := range strings.Fields(reply) {
+			if !known[word] {
+				t.Fatalf("Reply() => %q, with unknown word %q", reply, word)
+			}
+		}
+	}
+
+	wg.Wait()
+}
+
+func TestBlendLockOrder(t *testing.T) {
+	a, b := NewModel(Config{}), NewModel(Config{})
+
+	// Blends lock shared models in the same order, whatever order
+	// they were blended in.
+	for i, models := range [][]Blended{{{a, 1}, {b, 1}}, {{b, 1}, {a, 1}}} {
+		blend, err := NewBlend(Config{}, models...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if locking := blend.m.chains.(*blendChains).locking; locking[0] != a || locking[1] != b {
+			t.Errorf("blend %d locks the second model created first", i)
+		}
+	}
+}
+
+func TestNewBlend(t *testing.T) {
+	a, b := NewModel(Config{}), NewModel(Config{})
+
+	bad := [][]Blended{
+		nil,
+		{{a, 1}, {b, 0}},
+		{{a, -1}},
+		{{a, 1}, {a, 1}},
+	}
+
+	for _, models := range bad {
+		if _, err := NewBlend(Config{}, models...); err == nil {
+			t.Errorf("NewBlend(%v) => nil error", models)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"flag"
 	"fmt"
 	"os"
@@ -16,15 +17,37 @@ var historyFn = ".fate_console"
 
 func main() {
 	var (
-		maxlen int
+		maxlen    int
+		order     int
+		modelFile string
+		saveFile  string
 	)
 
-	flag.IntVar(&maxlen, "maxlen", 0, "maximum length for reply in UTF-8 chars")
+	flag.IntVar(&maxlen, "maxlen", 0, "maximum length for reply in bytes")
+	flag.IntVar(&order, "order", 3, "n-gram order of the model")
+	flag.StringVar(&modelFile, "model", "", "model snapshot to load before learning text files")
+	flag.StringVar(&saveFile, "save", "", "write a model snapshot here after learning")
 	flag.Parse()
 
-	model := fate.NewModel(fate.Config{})
+	if order < 3 || order > fate.MaxOrder {
+		fmt.Printf("Error: -order must be between 3 and %d\n", fate.MaxOrder)
+		os.Exit(1)
+	}
+
+	model := fate.NewModel(fate.Config{Order: order})
 
 	var learned bool
+	if modelFile != "" {
+		m, err := loadModel(modelFile)
+		if err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+
+		model = m
+		learned = true
+	}
+
 	for _, f := range flag.Args() {
 		err := learnFile(model, f)
 		if err != nil {
@@ -36,10 +59,17 @@ func main() {
 	}
 
 	if !learned {
-		fmt.Println("Usage: fate-console <text files>")
+		fmt.Println("Usage: fate-console [-model <snapshot>] <text files>")
 		os.Exit(1)
 	}
 
+	if saveFile != "" {
+		err := saveModel(model, saveFile)
+		if err != nil {
+			fmt.Printf("Error: %s\n", err)
+		}
+	}
+
 	console := liner.NewLiner()
 	console.SetCtrlCAborts(true)
 	defer console.Close()
@@ -49,7 +79,6 @@ func main() {
 		loadHistory(console, hist)
 	}
 
-loop:
 	for {
 		line, err := console.Prompt("> ")
 		if err != nil {
@@ -61,18 +90,20 @@ loop:
 			console.AppendHistory(line)
 		}
 
-		timeout := time.After(time.Second / 2)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second/2)
 
-		reply := model.Reply(line)
-		for maxlen > 0 && len(reply) > maxlen {
-			reply = model.Reply(line)
+		reply, err := model.ReplyWith(ctx, line, fate.ReplyOptions{MaxBytes: maxlen})
+		cancel()
 
-			select {
-			case <-timeout:
-				fmt.Println("ERROR: timed out")
-				continue loop
-			default:
-			}
+		if err == context.DeadlineExceeded {
+			fmt.Println("ERROR: timed out")
+			continue
+		} else if err == fate.ErrNoFit {
+			fmt.Println("ERROR: no reply fits maxlen")
+			continue
+		} else if err != nil {
+			fmt.Printf("ERROR: %s\n", err)
+			continue
 		}
 
 		fmt.Println(reply)
@@ -90,14 +121,51 @@ func learnFile(m *fate.Model, path string) error {
 	}
 	defer f.Close()
 
+	lines := make(chan string, 1024)
+	done := make(chan error, 1)
+	go func() {
+		_, err := m.LearnAll(context.Background(), lines, 0)
+		done <- err
+	}()
+
 	s := bufio.NewScanner(f)
 	for s.Scan() {
-		m.Learn(s.Text())
+		lines <- s.Text()
+	}
+	close(lines)
+
+	if err := <-done; err != nil {
+		return err
 	}
 
 	return s.Err()
 }
 
+func loadModel(path string) (*fate.Model, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return fate.ReadModel(f, fate.Config{})
+}
+
+func saveModel(m *fate.Model, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.WriteTo(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
 func loadHistory(console *liner.State, filename string) {
 	f, err := os.Open(filename)
 	if err != nil && !os.IsNotExist(err) {
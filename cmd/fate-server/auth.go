@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// scope is what a token allows: reading replies, or writing to models.
+type scope int
+
+const (
+	scopeRead scope = 1 << iota
+	scopeWrite
+)
+
+// tokenSet holds the bearer tokens clients may use, by hash so that
+// looking one up doesn't leak how much of a guess was right.
+type tokenSet map[[sha256.Size]byte]scope
+
+// readTokens reads a tokens file. Each line holds a token and its
+// comma-separated scopes, "read" and/or "write". Blank lines and lines
+// starting with # are ignored.
+func readTokens(path string) (tokenSet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tokens := make(tokenSet)
+
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want a token and its scopes", path, n)
+		}
+
+		var sc scope
+		for _, name := range strings.Split(fields[1], ",") {
+			switch name {
+			case "read":
+				sc |= scopeRead
+			case "write":
+				sc |= scopeWrite
+			default:
+				return nil, fmt.Errorf("%s:%d: unknown scope %q", path, n, name)
+			}
+		}
+
+		tokens[sha256.Sum256([]byte(fields[0]))] = sc
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// bearer returns the bearer token in req's Authorization header.
+func bearer(req *http.Request) (string, bool) {
+	h := req.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "bearer ") {
+		return "", false
+	}
+
+	return strings.TrimSpace(h[7:]), true
+}
+
+// limiter is a token bucket rate limiter per client.
+type limiter struct {
+	lock    sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// maxBuckets is how many clients a limiter tracks before it forgets
+// those whose buckets have refilled.
+const maxBuckets = 10000
+
+func newLimiter(rate float64, burst int) *limiter {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &limiter{rate: rate, burst: float64(burst), buckets: make(map[string]*bucket)}
+}
+
+// Allow takes a token from key's bucket. If there are none, it
+// returns false and how long until there will be.
+func (l *limiter) Allow(key string, now time.Time) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxBuckets {
+			l.sweep(now)
+		}
+
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := (1 - b.tokens) / l.rate
+		return false, time.Duration(wait * float64(time.Second))
+	}
+
+	b.tokens--
+	return true, 0
+}
+
+// sweep forgets clients whose buckets would be full by now, since
+// they're no different from new ones.
+func (l *limiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// gate checks requests' tokens, client certificates and rate limits
+// before handling them.
+type gate struct {
+	tokens  tokenSet
+	limits  map[string]*limiter
+	metrics *metrics
+	now     func() time.Time
+
+	// clientCerts requires writes to come with a verified client
+	// certificate.
+	clientCerts bool
+}
+
+func newGate(cfg *config, m *metrics) *gate {
+	g := &gate{
+		tokens:      cfg.tokens,
+		limits:      make(map[string]*limiter),
+		clientCerts: cfg.TLSClientCA != "",
+		metrics:     m,
+		now:         time.Now,
+	}
+
+	if cfg.RateLimit > 0 {
+		for _, endpoint := range []string{"learn", "reply"} {
+			g.limits[endpoint] = newLimiter(cfg.RateLimit, cfg.RateBurst)
+		}
+	}
+
+	return g
+}
+
+// wrap requires a token with sc, if the server has tokens, and a
+// client certificate for writes, if it checks them. It rate limits
+// endpoint per token or client address.
+func (g *gate) wrap(sc scope, endpoint string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		key := clientAddr(req)
+
+		if sc == scopeWrite && g.clientCerts && !verifiedClient(req) {
+			g.reject(w, req, endpoint, "forbidden", http.StatusForbidden, "Client certificate required")
+			return
+		}
+
+		if g.tokens != nil {
+			tok, ok := bearer(req)
+			have, known := g.tokens[sha256.Sum256([]byte(tok))]
+			switch {
+			case !ok || !known:
+				w.Header().Set("WWW-Authenticate", `Bearer realm="fate"`)
+				g.reject(w, req, endpoint, "unauthorized", http.StatusUnauthorized, "Missing or unknown bearer token")
+				return
+			case have&sc == 0:
+				g.reject(w, req, endpoint, "forbidden", http.StatusForbidden, "Token doesn't allow this")
+				return
+			}
+
+			key = "token:" + tok
+		}
+
+		if l, ok := g.limits[endpoint]; ok {
+			if ok, wait := l.Allow(key, g.now()); !ok {
+				secs := int(math.Ceil(wait.Seconds()))
+				if secs < 1 {
+					secs = 1
+				}
+				w.Header().Set("Retry-After", strconv.Itoa(secs))
+				g.reject(w, req, endpoint, "rate_limited", http.StatusTooManyRequests, "Too many requests")
+				return
+			}
+		}
+
+		h(w, req)
+	}
+}
+
+func (g *gate) reject(w http.ResponseWriter, req *http.Request, endpoint, reason string, code int, msg string) {
+	if endpoint == "learn" {
+		g.metrics.observeRejectedLearn(reason, 1)
+	}
+
+	if isJSON(req) {
+		jsonError(w, code, msg)
+	} else {
+		http.Error(w, msg, code)
+	}
+}
+
+// clientAddr returns the address of req's client, without its port.
+func clientAddr(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return "addr:" + req.RemoteAddr
+	}
+
+	return "addr:" + host
+}
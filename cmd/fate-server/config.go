@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pteichman/fate"
+)
+
+// config holds the server's settings. They come from flags and an
+// optional JSON config file; flags given on the command line win.
+type config struct {
+	// Addr is a TCP address, host:port, or a unix socket path
+	// prefixed with "unix:".
+	Addr string `json:"addr"`
+
+	ReadTimeout  duration `json:"read_timeout"`
+	WriteTimeout duration `json:"write_timeout"`
+	ReplyTimeout duration `json:"reply_timeout"`
+
+	// MaxLearnBytes caps the size of a learn request body.
+	MaxLearnBytes int64 `json:"max_learn_bytes"`
+
+	// DefaultMaxLen is the maxlen of replies that don't set one.
+	DefaultMaxLen int `json:"default_maxlen"`
+
+	Model            string   `json:"model"`
+	Journal          string   `json:"journal"`
+	SnapshotInterval duration `json:"snapshot_interval"`
+	Corpus           []string `json:"corpus"`
+
+	ModelsDir  string        `json:"models_dir"`
+	ModelsFile string        `json:"models_file"`
+	LazyModels bool          `json:"lazy_models"`
+	Models     []modelConfig `json:"models"`
+
+	// MaxModels caps the named models: once there are that many,
+	// learning under a new name fails. Zero means no limit.
+	MaxModels int `json:"max_models"`
+
+	// TokensFile holds the bearer tokens clients must use. Without
+	// one, anyone can learn and reply.
+	TokensFile string `json:"tokens_file"`
+
+	// RateLimit is the number of learns, and separately replies,
+	// each token or client address may make per second, with bursts
+	// of up to RateBurst. Zero means no limit.
+	RateLimit float64 `json:"rate_limit"`
+	RateBurst int     `json:"rate_burst"`
+
+	// TLSCert and TLSKey make the server speak HTTPS. With
+	// TLSClientCA, learning and the admin endpoints also require a
+	// client certificate signed by one of its CAs. All three are
+	// reloaded on SIGHUP.
+	TLSCert     string `json:"tls_cert"`
+	TLSKey      string `json:"tls_key"`
+	TLSClientCA string `json:"tls_client_ca"`
+
+	tokens  tokenSet
+	certs   *certs
+	journal *fate.Journal
+}
+
+func defaultConfig() *config {
+	return &config{
+		Addr:             ":8080",
+		ReadTimeout:      duration(5 * time.Second),
+		WriteTimeout:     duration(10 * time.Second),
+		ReplyTimeout:     duration(time.Second),
+		MaxLearnBytes:    1 << 20,
+		SnapshotInterval: duration(5 * time.Minute),
+		LazyModels:       true,
+		MaxModels:        100,
+		RateBurst:        10,
+	}
+}
+
+// flags registers flags that set c's fields.
+func (c *config) flags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Addr, "addr", c.Addr, "listen address: host:port, or unix:<path> for a unix socket")
+	fs.Var(&c.ReadTimeout, "read-timeout", "maximum time to read a request")
+	fs.Var(&c.WriteTimeout, "write-timeout", "maximum time to write a response")
+	fs.Var(&c.ReplyTimeout, "reply-timeout", "maximum time to generate a reply")
+	fs.Int64Var(&c.MaxLearnBytes, "max-learn-bytes", c.MaxLearnBytes, "maximum size of a learn request body")
+	fs.IntVar(&c.DefaultMaxLen, "maxlen", c.DefaultMaxLen, "maximum reply length in bytes when a request doesn't set one")
+	fs.StringVar(&c.Model, "model", c.Model, "model snapshot to load at startup and save to while running; text files seed a new one")
+	fs.StringVar(&c.Journal, "journal", c.Journal, "journal of lines learned since the last snapshot; requires -model")
+	fs.Var(&c.SnapshotInterval, "snapshot-interval", "how often to save the model snapshot")
+	fs.StringVar(&c.ModelsDir, "models-dir", c.ModelsDir, "directory of snapshots for the named models under /m/")
+	fs.StringVar(&c.ModelsFile, "models", c.ModelsFile, "JSON file describing named models to create at startup")
+	fs.BoolVar(&c.LazyModels, "lazy-models", c.LazyModels, "create named models the first time they learn")
+	fs.IntVar(&c.MaxModels, "max-models", c.MaxModels, "most named models to create the first time they learn; 0 for no limit")
+	fs.StringVar(&c.TokensFile, "tokens", c.TokensFile, "file of bearer tokens and their scopes (read, write)")
+	fs.Float64Var(&c.RateLimit, "rate-limit", c.RateLimit, "learns and replies per second per client; 0 for no limit")
+	fs.IntVar(&c.RateBurst, "rate-burst", c.RateBurst, "requests a client may burst above -rate-limit")
+	fs.StringVar(&c.TLSCert, "tls-cert", c.TLSCert, "TLS certificate file; serve HTTPS with -tls-key")
+	fs.StringVar(&c.TLSKey, "tls-key", c.TLSKey, "TLS private key file")
+	fs.StringVar(&c.TLSClientCA, "tls-client-ca", c.TLSClientCA, "CA bundle for client certificates, required to learn")
+}
+
+// parseConfig reads the server's configuration from args: flags,
+// including -config for a config file, followed by corpus files.
+func parseConfig(name string, args []string) (*config, error) {
+	c := defaultConfig()
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [flags] <text files>\n", name)
+		fs.PrintDefaults()
+	}
+
+	var file string
+	fs.StringVar(&file, "config", "", "JSON config file; flags override its settings")
+	c.flags(fs)
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if file != "" {
+		fc, err := readConfig(file)
+		if err != nil {
+			return nil, err
+		}
+
+		// Apply the flags given on the command line over the file.
+		override := flag.NewFlagSet(name, flag.ContinueOnError)
+		fc.flags(override)
+
+		var err2 error
+		fs.Visit(func(f *flag.Flag) {
+			if f.Name != "config" && err2 == nil {
+				err2 = override.Set(f.Name, f.Value.String())
+			}
+		})
+		if err2 != nil {
+			return nil, err2
+		}
+
+		c = fc
+	}
+
+	c.Corpus = append(c.Corpus, fs.Args()...)
+
+	if c.ModelsFile != "" {
+		mc, err := readModelsConfig(c.ModelsFile)
+		if err != nil {
+			return nil, err
+		}
+		c.Models = append(c.Models, mc.Models...)
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// readConfig reads a JSON config file over the defaults.
+func readConfig(path string) (*config, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := defaultConfig()
+
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	return c, nil
+}
+
+// configError lists everything wrong with a configuration.
+type configError []string
+
+func (e configError) Error() string {
+	return "invalid configuration:\n\t" + strings.Join(e, "\n\t")
+}
+
+// validate checks c for mistakes that would otherwise show up after
+// startup, or not at all.
+func (c *config) validate() error {
+	var errs configError
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+
+	if network, addr := c.listenAddr(); network == "unix" {
+		if addr == "" {
+			fail("addr %q: missing socket path", c.Addr)
+		}
+	} else if _, port, err := net.SplitHostPort(addr); err != nil {
+		fail("addr %q: %s", c.Addr, err)
+	} else if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		fail("addr %q: invalid port %q", c.Addr, port)
+	}
+
+	if c.ReadTimeout < 0 {
+		fail("read_timeout %s: must not be negative", c.ReadTimeout)
+	}
+	if c.WriteTimeout < 0 {
+		fail("write_timeout %s: must not be negative", c.WriteTimeout)
+	}
+	if c.ReplyTimeout <= 0 {
+		fail("reply_timeout %s: must be positive", c.ReplyTimeout)
+	}
+	if c.WriteTimeout > 0 && c.ReplyTimeout >= c.WriteTimeout {
+		fail("reply_timeout %s: must be less than write_timeout %s", c.ReplyTimeout, c.WriteTimeout)
+	}
+	if c.MaxLearnBytes <= 0 {
+		fail("max_learn_bytes %d: must be positive", c.MaxLearnBytes)
+	}
+	if c.DefaultMaxLen < 0 {
+		fail("default_maxlen %d: must not be negative", c.DefaultMaxLen)
+	}
+	if c.SnapshotInterval <= 0 {
+		fail("snapshot_interval %s: must be positive", c.SnapshotInterval)
+	}
+	if c.MaxModels < 0 {
+		fail("max_models %d: must not be negative", c.MaxModels)
+	}
+
+	if c.RateLimit < 0 || math.IsNaN(c.RateLimit) || math.IsInf(c.RateLimit, 0) {
+		fail("rate_limit %v: must not be negative", c.RateLimit)
+	}
+	if c.RateBurst < 1 {
+		fail("rate_burst %d: must be positive", c.RateBurst)
+	}
+
+	if c.TokensFile != "" {
+		tokens, err := readTokens(c.TokensFile)
+		if err != nil {
+			fail("tokens_file: %s", err)
+		}
+		c.tokens = tokens
+	}
+
+	switch {
+	case (c.TLSCert == "") != (c.TLSKey == ""):
+		fail("tls_cert and tls_key: must be given together")
+	case c.TLSClientCA != "" && c.TLSCert == "":
+		fail("tls_client_ca %q: requires tls_cert and tls_key", c.TLSClientCA)
+	case c.TLSCert != "":
+		certs, err := newCerts(c.TLSCert, c.TLSKey, c.TLSClientCA)
+		if err != nil {
+			fail("tls: %s", err)
+		}
+		c.certs = certs
+	}
+
+	if c.Journal != "" && c.Model == "" {
+		fail("journal %q: requires a model snapshot", c.Journal)
+	}
+
+	for _, f := range c.Corpus {
+		if _, err := os.Stat(f); err != nil {
+			fail("corpus: %s", err)
+		}
+	}
+
+	// The corpus seeds a new snapshot. Learning it again over an
+	// existing one would count it twice in a weighted model.
+	if c.Model != "" && len(c.Corpus) > 0 {
+		if _, err := os.Stat(c.Model); err == nil {
+			fail("corpus: model %q already has a snapshot; learn new text through /learn", c.Model)
+		}
+	}
+
+	if c.ModelsDir != "" {
+		if info, err := os.Stat(c.ModelsDir); err != nil {
+			fail("models_dir: %s", err)
+		} else if !info.IsDir() {
+			fail("models_dir %q: not a directory", c.ModelsDir)
+		}
+	}
+
+	if err := validateModels(c.Models); err != nil {
+		fail("models: %s", err)
+	}
+
+	for _, m := range c.Models {
+		for _, f := range m.Corpus {
+			if _, err := os.Stat(f); err != nil {
+				fail("model %q corpus: %s", m.Name, err)
+			}
+		}
+	}
+
+	if c.Model == "" && c.ModelsDir == "" && len(c.Models) == 0 && len(c.Corpus) == 0 {
+		fail("nothing to serve: give text files, a model, models_dir or models")
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// listenAddr returns the network and address to listen on.
+func (c *config) listenAddr() (string, string) {
+	if strings.HasPrefix(c.Addr, "unix:") {
+		return "unix", strings.TrimPrefix(c.Addr, "unix:")
+	}
+
+	return "tcp", c.Addr
+}
+
+// listen opens the configured listener. A unix socket left behind by
+// an earlier server is removed first.
+func (c *config) listen() (net.Listener, error) {
+	network, addr := c.listenAddr()
+	if network == "unix" {
+		if info, err := os.Stat(addr); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(addr)
+		}
+	}
+
+	return net.Listen(network, addr)
+}
+
+// duration is a time.Duration that reads from JSON strings like "5s",
+// and works as a flag.Value.
+type duration time.Duration
+
+func (d duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d *duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = duration(v)
+	return nil
+}
+
+func (d *duration) UnmarshalJSON(buf []byte) error {
+	var s string
+	if err := json.Unmarshal(buf, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"5s\"")
+	}
+
+	return d.Set(s)
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
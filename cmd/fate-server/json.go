@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/pteichman/fate"
+)
+
+// maxCandidates caps the candidates a single JSON reply may generate.
+const maxCandidates = 100
+
+type replyRequest struct {
+	Q          string `json:"q"`
+	MaxLen     int    `json:"maxlen"`
+	Seed       *int64 `json:"seed"`
+	Candidates int    `json:"candidates"`
+}
+
+type replyResponse struct {
+	Reply     string   `json:"reply"`
+	Tokens    []string `json:"tokens"`
+	Pivot     string   `json:"pivot"`
+	ElapsedMS float64  `json:"elapsed_ms"`
+}
+
+type learnRequest struct {
+	Lines []string `json:"lines"`
+}
+
+type learnResponse struct {
+	Accepted int         `json:"accepted"`
+	Rejected int         `json:"rejected"`
+	Lines    []learnLine `json:"lines"`
+}
+
+// learnLine is the result of learning one line. Lines with fewer than
+// two words are rejected.
+type learnLine struct {
+	Accepted bool   `json:"accepted"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+type errorResponse struct {
+	Error errorBody `json:"error"`
+}
+
+type errorBody struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// isJSON reports whether req has a JSON body.
+func isJSON(req *http.Request) bool {
+	typ, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return err == nil && typ == "application/json"
+}
+
+func (h handler) replyJSON(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		jsonError(w, http.StatusMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	var r replyRequest
+	if !decodeJSON(w, req, &r, h.cfg.MaxLearnBytes) {
+		return
+	}
+
+	if r.MaxLen < 0 || r.Candidates < 0 || r.Candidates > maxCandidates {
+		jsonError(w, http.StatusBadRequest, "maxlen and candidates must be in range")
+		return
+	}
+
+	if r.MaxLen == 0 {
+		r.MaxLen = h.cfg.DefaultMaxLen
+	}
+
+	opts := fate.ReplyOptions{MaxBytes: r.MaxLen, Candidates: r.Candidates}
+	if r.Seed != nil {
+		opts.Rand = rand.NewSource(*r.Seed)
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), time.Duration(h.cfg.ReplyTimeout))
+	defer cancel()
+
+	start := time.Now()
+	c, err := h.generate(ctx, r.Q, opts)
+	elapsed := time.Since(start)
+
+	if err != nil {
+		code, msg := replyError(err)
+		jsonError(w, code, msg)
+		return
+	}
+
+	res := replyResponse{
+		Tokens:    []string{},
+		ElapsedMS: float64(elapsed) / float64(time.Millisecond),
+	}
+
+	if c != nil {
+		res.Reply, res.Tokens, res.Pivot = c.Text, c.Words, c.Pivot
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (h handler) learnJSON(w http.ResponseWriter, req *http.Request) {
+	var r learnRequest
+	if !decodeJSON(w, req, &r, h.cfg.MaxLearnBytes) {
+		return
+	}
+
+	res := learnResponse{Lines: make([]learnLine, len(r.Lines))}
+	for i, line := range r.Lines {
+		if !h.model.Learnable(line) {
+			res.Lines[i] = learnLine{Reason: "fewer than two words"}
+			res.Rejected++
+			h.metrics.observeRejectedLearn("too_short", 1)
+			continue
+		}
+
+		h.model.Learn(line)
+		res.Lines[i] = learnLine{Accepted: true}
+		res.Accepted++
+	}
+
+	if err := h.journalErr(); err != nil {
+		jsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+// decodeJSON reads up to max bytes of req's body into v, writing an
+// error response and returning false if it can't.
+func decodeJSON(w http.ResponseWriter, req *http.Request, v interface{}, max int64) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, req.Body, max))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(v); err != nil {
+		jsonError(w, bodyError(err), "Invalid JSON: "+err.Error())
+		return false
+	}
+
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func jsonError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, errorResponse{errorBody{Code: code, Message: msg}})
+}
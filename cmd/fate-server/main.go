@@ -2,77 +2,276 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/pteichman/fate"
 )
 
 func main() {
-	flag.Parse()
+	cfg, err := parseConfig(os.Args[0], os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var journal *fate.Journal
+	if cfg.Journal != "" {
+		journal, err = fate.OpenJournal(cfg.Journal)
+		if err != nil {
+			log.Fatalf("Opening %s: %s\n", cfg.Journal, err)
+		}
+		defer journal.Close()
+		cfg.journal = journal
+	}
+
+	model, err := startModel(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	reg := newRegistry(cfg.ModelsDir, cfg.LazyModels)
+	if err := reg.Load(modelsConfig{Models: cfg.Models}); err != nil {
+		log.Fatal(err)
+	}
+
+	ln, err := cfg.listen()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if cfg.certs != nil {
+		ln = tls.NewListener(ln, cfg.certs.Config())
+		go reloadCerts(cfg.certs)
+	}
+
+	srv := &http.Server{
+		Handler:      newHandler(model, reg, cfg),
+		ReadTimeout:  time.Duration(cfg.ReadTimeout),
+		WriteTimeout: time.Duration(cfg.WriteTimeout),
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	var savers []saver
+	if cfg.Model != "" {
+		savers = append(savers, newSnapshotter(model, cfg.Model, journal))
+	}
+	if cfg.ModelsDir != "" {
+		savers = append(savers, reg)
+	}
+
+	var wg sync.WaitGroup
+	for _, s := range savers {
+		wg.Add(1)
+		go func(s saver) {
+			defer wg.Done()
+			saveEvery(ctx, s, time.Duration(cfg.SnapshotInterval))
+		}(s)
+	}
 
-	if flag.NArg() == 0 {
-		fmt.Println("Usage: fate-server <text files>")
+	go func() {
+		if err := srv.Serve(ln); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+
+	// Let in-flight requests finish before the final snapshot.
+	shutdown, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdown); err != nil {
+		log.Printf("Shutting down: %s\n", err)
+	}
+
+	wg.Wait()
+
+	failed := false
+	for _, s := range savers {
+		if err := s.Save(); err != nil {
+			log.Printf("Saving snapshot: %s\n", err)
+			failed = true
+		}
+	}
+
+	if failed {
 		os.Exit(1)
 	}
+}
 
-	model := fate.NewModel(fate.Config{})
-	for _, f := range flag.Args() {
-		err := learnFile(model, f)
+// startModel loads the server's model from its snapshot and journal.
+// A model without a snapshot learns the corpus files instead; validate
+// refuses corpus files once there is one, since it has them. With a journal, it's compacted into a new
+// snapshot, so it only ever holds lines learned while serving.
+func startModel(cfg *config) (*fate.Model, error) {
+	model, loaded, err := loadModel(cfg.Model, fate.Config{Journal: cfg.journal})
+	if err != nil {
+		return nil, fmt.Errorf("loading %s: %s", cfg.Model, err)
+	}
+
+	if cfg.journal != nil {
+		n, err := cfg.journal.Replay(model)
 		if err != nil {
-			log.Printf("Learning %s: %s\n", f, err)
-			continue
+			return nil, fmt.Errorf("replaying %s: %s", cfg.Journal, err)
 		}
+		log.Printf("Replayed %d records from %s\n", n, cfg.Journal)
 	}
 
-	http.Handle("/", NewHandler(model))
+	if !loaded && len(cfg.Corpus) > 0 {
+		// Learn the corpus outside the journal; the snapshot
+		// below keeps it.
+		corpus := model
+		if cfg.journal != nil {
+			corpus = fate.NewModel(fate.Config{})
+		}
+
+		for _, f := range cfg.Corpus {
+			if err := learnFile(corpus, f); err != nil {
+				log.Printf("Learning %s: %s\n", f, err)
+			}
+		}
 
-	srv := &http.Server{
-		Addr:         ":8080",
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
+		if corpus != model {
+			if err := fate.Merge(model, corpus); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if cfg.journal != nil {
+		if err := cfg.journal.Compact(model, cfg.Model); err != nil {
+			return nil, fmt.Errorf("compacting %s: %s", cfg.Journal, err)
+		}
 	}
 
-	log.Fatal(srv.ListenAndServe())
+	return model, nil
+}
+
+// reloadCerts reloads c's files whenever the server gets SIGHUP.
+func reloadCerts(c *certs) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for range hup {
+		if err := c.Reload(); err != nil {
+			log.Printf("Reloading certificates: %s\n", err)
+			continue
+		}
+		log.Printf("Reloaded certificates\n")
+	}
 }
 
 func NewHandler(m *fate.Model) http.Handler {
-	h := handler{model: m}
+	return newHandler(m, nil, defaultConfig())
+}
+
+// newHandler serves m at /learn, /reply and /reply/stream, and the models in reg, if
+// any, under /m/.
+func newHandler(m *fate.Model, reg *registry, cfg *config) http.Handler {
+	h := handler{model: m, journal: cfg.journal, metrics: newMetrics(), cfg: cfg}
+	g := newGate(cfg, h.metrics)
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/learn", h.learn)
-	mux.HandleFunc("/reply", h.reply)
+	mux.HandleFunc("/learn", h.metrics.instrument("learn", g.wrap(scopeWrite, "learn", h.learn)))
+	mux.HandleFunc("/reply", h.metrics.instrument("reply", g.wrap(scopeRead, "reply", h.reply)))
+	mux.HandleFunc("/reply/stream", h.metrics.instrument("reply_stream", g.wrap(scopeRead, "reply", h.replyStream)))
+	mux.HandleFunc("/metrics", g.wrap(scopeRead, "metrics", h.serveMetrics))
+
+	if reg != nil {
+		reg.metrics, reg.cfg, reg.gate = h.metrics, cfg, g
+		mux.Handle("/m/", reg)
+		mux.HandleFunc("/admin/models", g.wrap(scopeWrite, "admin", reg.serveAdmin))
+		mux.HandleFunc("/admin/models/", g.wrap(scopeWrite, "admin", reg.serveAdmin))
+	}
+
 	return mux
 }
 
 type handler struct {
 	model *fate.Model
+
+	// journal is model's journal, if it has one.
+	journal *fate.Journal
+
+	metrics *metrics
+	cfg     *config
 }
 
 func (h handler) reply(w http.ResponseWriter, req *http.Request) {
-	timeout := time.After(time.Second)
+	if isJSON(req) {
+		h.replyJSON(w, req)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), time.Duration(h.cfg.ReplyTimeout))
+	defer cancel()
 
 	q := req.FormValue("q")
 	maxlen := parseint(req.FormValue("maxlen"))
+	if maxlen == 0 {
+		maxlen = h.cfg.DefaultMaxLen
+	}
+
+	c, err := h.generate(ctx, q, fate.ReplyOptions{MaxBytes: maxlen})
+	if err != nil {
+		code, msg := replyError(err)
+		http.Error(w, msg, code)
+		return
+	}
 
-	reply := h.model.Reply(q)
-	for maxlen > 0 && len(reply) > maxlen {
-		select {
-		case <-timeout:
-			http.Error(w, "Request timed out", http.StatusServiceUnavailable)
-			return
-		default:
+	if c != nil {
+		w.Write([]byte(c.Text))
+	}
+}
+
+// generate replies to q, recording metrics about the reply.
+func (h handler) generate(ctx context.Context, q string, opts fate.ReplyOptions) (*fate.Candidate, error) {
+	start := time.Now()
+	c, err := h.model.ReplyCandidate(ctx, q, opts)
+	h.metrics.observeReply(time.Since(start))
+
+	if opts.MaxBytes > 0 && (err == nil || err == fate.ErrNoFit) {
+		if err == nil {
+			h.metrics.observeMaxlen("fit")
+		} else {
+			h.metrics.observeMaxlen("nofit")
 		}
+	}
+
+	if err == context.DeadlineExceeded || err == context.Canceled {
+		h.metrics.observeTimeout()
+	}
+
+	return c, err
+}
 
-		reply = h.model.Reply(q)
+// replyError returns the status code and message for a failed reply.
+func replyError(err error) (int, string) {
+	switch {
+	case err == context.DeadlineExceeded || err == context.Canceled:
+		return http.StatusServiceUnavailable, "Request timed out"
+	case err == fate.ErrNoFit:
+		return http.StatusServiceUnavailable, "No reply fits maxlen"
 	}
 
-	w.Write([]byte(reply))
+	return http.StatusInternalServerError, err.Error()
 }
 
 func (h handler) learn(w http.ResponseWriter, req *http.Request) {
@@ -81,8 +280,55 @@ func (h handler) learn(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if isJSON(req) {
+		h.learnJSON(w, req)
+		return
+	}
+
+	req.Body = http.MaxBytesReader(w, req.Body, h.cfg.MaxLearnBytes)
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, err.Error(), bodyError(err))
+		return
+	}
+
 	q := req.FormValue("q")
+	if !h.model.Learnable(q) {
+		h.metrics.observeRejectedLearn("too_short", 1)
+		return
+	}
+
 	h.model.Learn(q)
+
+	if err := h.journalErr(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// journalErr returns the error that stopped the model's journal, if it
+// has one, logging it. Lines learned after that are lost in a crash.
+func (h handler) journalErr() error {
+	if h.journal == nil {
+		return nil
+	}
+
+	err := h.journal.Err()
+	if err != nil {
+		err = fmt.Errorf("journal failed: %s", err)
+		log.Printf("Learning: %s\n", err)
+	}
+
+	return err
+}
+
+// bodyError returns the status code for an error reading a request
+// body: too large, or malformed.
+func bodyError(err error) int {
+	// http.MaxBytesReader's error has no type to check for.
+	if strings.Contains(err.Error(), "request body too large") {
+		return http.StatusRequestEntityTooLarge
+	}
+
+	return http.StatusBadRequest
 }
 
 func parseint(s string) int {
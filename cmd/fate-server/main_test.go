@@ -1,11 +1,27 @@
 package main
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/pteichman/fate"
 )
@@ -123,3 +139,1166 @@ func TestReplyTimeout(t *testing.T) {
 		t.Fatalf("GET /reply -> %v, want %v", res.StatusCode, http.StatusServiceUnavailable)
 	}
 }
+
+func TestReplyMaxlen(t *testing.T) {
+	model := fate.NewModel(fate.Config{})
+	model.Learn("foo bar baz")
+	model.Learn("foo bar baz quux quuux quuuux")
+
+	ts := NewServer(model)
+	defer ts.Close()
+
+	for i := 0; i < 100; i++ {
+		res, err := http.Get(ts.URL + "/reply?q=foo&maxlen=11")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusOK || string(body) != "foo bar baz" {
+			t.Fatalf("GET /reply?q=foo&maxlen=11 -> %v %q, want %v %q", res.StatusCode, body, http.StatusOK, "foo bar baz")
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	model := fate.NewModel(fate.Config{})
+	model.Learn("foo bar baz")
+
+	ts := NewServer(model)
+	defer ts.Close()
+
+	for _, path := range []string{"/reply?q=foo", "/reply?q=foo&maxlen=11", "/reply?q=foo&maxlen=1", "/learn"} {
+		res, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+
+	res, err := http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	want := []string{
+		`fate_requests_total{endpoint="learn",code="405"} 1`,
+		`fate_requests_total{endpoint="reply",code="200"} 2`,
+		`fate_requests_total{endpoint="reply",code="503"} 1`,
+		`fate_reply_duration_seconds_bucket{le="+Inf"} 3`,
+		`fate_reply_duration_seconds_count 3`,
+		`fate_reply_maxlen_total{result="fit"} 1`,
+		`fate_reply_maxlen_total{result="nofit"} 1`,
+		`fate_reply_timeouts_total 0`,
+		`fate_model_tokens 5`,
+		`fate_model_contexts{length="2"} 6`,
+	}
+
+	lines := make(map[string]bool)
+	for _, line := range strings.Split(string(body), "\n") {
+		lines[line] = true
+	}
+
+	for _, line := range want {
+		if !lines[line] {
+			t.Errorf("GET /metrics missing %q:\n%s", line, body)
+		}
+	}
+}
+
+func postJSON(t *testing.T, url string, body string, v interface{}) int {
+	res, err := http.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if ct := res.Header.Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("POST %s -> Content-Type %q, want application/json", url, ct)
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+
+	return res.StatusCode
+}
+
+func TestReplyJSON(t *testing.T) {
+	model := fate.NewModel(fate.Config{})
+	model.Learn("foo bar baz")
+	model.Learn("foo bar quux quuux")
+
+	ts := NewServer(model)
+	defer ts.Close()
+
+	var first replyResponse
+	code := postJSON(t, ts.URL+"/reply", `{"q": "foo", "seed": 3, "candidates": 2}`, &first)
+	if code != http.StatusOK {
+		t.Fatalf("POST /reply -> %v, want %v", code, http.StatusOK)
+	}
+
+	if first.Reply != strings.Join(first.Tokens, " ") || first.Pivot != "foo" {
+		t.Errorf("POST /reply -> %+v, want tokens of the reply and pivot foo", first)
+	}
+
+	// The same seed gets the same reply.
+	for i := 0; i < 10; i++ {
+		var res replyResponse
+		postJSON(t, ts.URL+"/reply", `{"q": "foo", "seed": 3, "candidates": 2}`, &res)
+		if res.Reply != first.Reply {
+			t.Fatalf("POST /reply seed 3 -> %q, want %q", res.Reply, first.Reply)
+		}
+	}
+
+	var res replyResponse
+	postJSON(t, ts.URL+"/reply", `{"q": "foo", "maxlen": 11}`, &res)
+	if res.Reply != "foo bar baz" {
+		t.Errorf("POST /reply maxlen 11 -> %q, want %q", res.Reply, "foo bar baz")
+	}
+}
+
+func TestReplyStream(t *testing.T) {
+	model := fate.NewModel(fate.Config{})
+	model.Learn("foo bar baz")
+	model.Learn("foo bar quux quuux")
+
+	ts := NewServer(model)
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/reply/stream?q=foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if typ := res.Header.Get("Content-Type"); typ != "text/event-stream" {
+		t.Errorf("GET /reply/stream Content-Type -> %q, want text/event-stream", typ)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tokens []string
+	var done *doneEvent
+	for _, ev := range strings.Split(strings.TrimSpace(string(body)), "\n\n") {
+		lines := strings.Split(ev, "\n")
+		if len(lines) != 2 || !strings.HasPrefix(lines[1], "data: ") {
+			t.Fatalf("GET /reply/stream -> malformed event %q", ev)
+		}
+		data := []byte(strings.TrimPrefix(lines[1], "data: "))
+
+		switch lines[0] {
+		case "event: token":
+			var tok tokenEvent
+			if err := json.Unmarshal(data, &tok); err != nil {
+				t.Fatal(err)
+			}
+			tokens = append(tokens, tok.Token)
+		case "event: done":
+			done = &doneEvent{}
+			if err := json.Unmarshal(data, done); err != nil {
+				t.Fatal(err)
+			}
+		default:
+			t.Fatalf("GET /reply/stream -> unexpected event %q", ev)
+		}
+	}
+
+	if done == nil || done.Reply != strings.Join(tokens, " ") || tokens[0] != "foo" {
+		t.Errorf("GET /reply/stream -> tokens %q, done %+v", tokens, done)
+	}
+}
+
+func TestLearnJSON(t *testing.T) {
+	model := fate.NewModel(fate.Config{})
+
+	ts := NewServer(model)
+	defer ts.Close()
+
+	var res learnResponse
+	code := postJSON(t, ts.URL+"/learn", `{"lines": ["foo bar baz", "single", "", "foo bar"]}`, &res)
+	if code != http.StatusOK {
+		t.Fatalf("POST /learn -> %v, want %v", code, http.StatusOK)
+	}
+
+	if res.Accepted != 2 || res.Rejected != 2 || len(res.Lines) != 4 {
+		t.Fatalf("POST /learn -> %+v, want 2 accepted and 2 rejected", res)
+	}
+
+	for i, want := range []bool{true, false, false, true} {
+		if res.Lines[i].Accepted != want {
+			t.Errorf("POST /learn line %d -> %+v, want accepted %v", i, res.Lines[i], want)
+		}
+	}
+
+	if model.Reply("baz") == "" {
+		t.Errorf("POST /learn didn't learn")
+	}
+}
+
+func TestJSONErrors(t *testing.T) {
+	model := fate.NewModel(fate.Config{})
+	model.Learn("foo bar baz")
+
+	ts := NewServer(model)
+	defer ts.Close()
+
+	tests := []struct {
+		path, body string
+		code       int
+	}{
+		{"/reply", `{"q": "foo", "maxlen": 1}`, http.StatusServiceUnavailable},
+		{"/reply", `{"q": `, http.StatusBadRequest},
+		{"/reply", `{"q": "foo", "candidates": -1}`, http.StatusBadRequest},
+		{"/learn", `{"text": "foo bar"}`, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		var res errorResponse
+		code := postJSON(t, ts.URL+tt.path, tt.body, &res)
+		if code != tt.code || res.Error.Code != tt.code || res.Error.Message == "" {
+			t.Errorf("POST %s %s -> %v %+v, want %v", tt.path, tt.body, code, res, tt.code)
+		}
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fate-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "model.fate")
+
+	// A missing snapshot starts an empty model.
+	model, loaded, err := loadModel(path, fate.Config{})
+	if err != nil || loaded {
+		t.Fatalf("loadModel(missing) => %v, %v", loaded, err)
+	}
+
+	snap := newSnapshotter(model, path, nil)
+	if err := snap.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("Save() wrote an unchanged model: %v", err)
+	}
+
+	model.Learn("foo bar baz")
+	if err := snap.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, loaded, err := loadModel(path, fate.Config{})
+	if err != nil || !loaded {
+		t.Fatalf("loadModel() => %v, %v after Save()", loaded, err)
+	}
+
+	if reply := reloaded.Reply("foo"); reply != "foo bar baz" {
+		t.Errorf("Reply(foo) => %q after reload, want %q", reply, "foo bar baz")
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 1 {
+		t.Errorf("Save() left %d files, want 1", len(files))
+	}
+}
+
+func TestSaveEvery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fate-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "model.fate")
+
+	model := fate.NewModel(fate.Config{})
+	model.Learn("foo bar baz")
+
+	snap := newSnapshotter(model, path, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		saveEvery(ctx, snap, time.Millisecond)
+		close(done)
+	}()
+
+	model.Learn("foo bar quux")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Run() didn't write a snapshot")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	<-done
+}
+
+func TestSnapshotJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fate-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path, journalPath := filepath.Join(dir, "model.fate"), filepath.Join(dir, "journal")
+
+	journal, err := fate.OpenJournal(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+
+	model, _, err := loadModel(path, fate.Config{Journal: journal})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snap := newSnapshotter(model, path, journal)
+	model.Learn("foo bar baz")
+
+	before, err := os.Stat(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := snap.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := os.Stat(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if after.Size() >= before.Size() {
+		t.Errorf("Save() left the journal at %d bytes, want less than %d", after.Size(), before.Size())
+	}
+
+	loaded, _, err := loadModel(path, fate.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reply := loaded.Reply("foo"); reply != "foo bar baz" {
+		t.Errorf("Reply(foo) => %q after reload, want %q", reply, "foo bar baz")
+	}
+}
+
+func TestSnapshotCorpus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fate-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	corpus := filepath.Join(dir, "corpus.txt")
+	if err := ioutil.WriteFile(corpus, []byte("foo bar baz\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := defaultConfig()
+	cfg.Model = filepath.Join(dir, "model.fate")
+	cfg.Corpus = []string{corpus}
+
+	model, err := startModel(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The corpus is saved even if nothing is learned while serving.
+	if err := newSnapshotter(model, cfg.Model, nil).Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(cfg.Model); err != nil {
+		t.Errorf("Save() after learning the corpus => %v", err)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fate-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	corpus := filepath.Join(dir, "corpus.txt")
+	if err := ioutil.WriteFile(corpus, []byte("foo bar baz\nfoo bar quux\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := defaultConfig()
+	cfg.Model = filepath.Join(dir, "model.fate")
+	cfg.Journal = filepath.Join(dir, "journal")
+	cfg.Corpus = []string{corpus}
+
+	// start starts the server's model as main does, learning line
+	// and stopping without a final snapshot.
+	start := func(line string) (fate.Stats, int64) {
+		journal, err := fate.OpenJournal(cfg.Journal)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer journal.Close()
+		cfg.journal = journal
+
+		model, err := startModel(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stats := model.Stats()
+
+		info, err := os.Stat(cfg.Journal)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if line != "" {
+			model.Learn(line)
+		}
+
+		return stats, info.Size()
+	}
+
+	start("foo bar bar")
+
+	// The corpus is in the snapshot now, so it can't be given again.
+	if err := cfg.validate(); err == nil || !strings.Contains(err.Error(), "already has a snapshot") {
+		t.Errorf("validate() with a corpus and an existing snapshot => %v", err)
+	}
+	cfg.Corpus = nil
+	if err := cfg.validate(); err != nil {
+		t.Errorf("validate() without the corpus => %v", err)
+	}
+
+	// The journal only has what was learned since the snapshot, so
+	// restarting learns nothing twice.
+	first, size := start("")
+	second, size2 := start("")
+
+	// Only the first restart has a line to replay.
+	if first.Learned != 1 || second.Learned != 0 {
+		t.Errorf("restarts learned %d and %d lines, want 1 and 0", first.Learned, second.Learned)
+	}
+
+	first.Learned = 0
+	if second != first {
+		t.Errorf("Stats() => %+v after restarting again, want %+v", second, first)
+	}
+	if size2 != size {
+		t.Errorf("journal is %d bytes after restarting again, want %d", size2, size)
+	}
+}
+
+func TestJournalFailed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fate-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	journal, err := fate.OpenJournal(filepath.Join(dir, "journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Appending to a closed journal fails.
+	journal.Close()
+
+	cfg := defaultConfig()
+	cfg.journal = journal
+
+	ts := httptest.NewServer(newHandler(fate.NewModel(fate.Config{Journal: journal}), newRegistry("", true), cfg))
+	defer ts.Close()
+
+	res, err := http.PostForm(ts.URL+"/learn", url.Values{"q": {"foo bar baz"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusInternalServerError {
+		t.Errorf("POST /learn -> %v with a failed journal, want %v", res.StatusCode, http.StatusInternalServerError)
+	}
+
+	// Named models don't use the default model's journal.
+	res, err = http.PostForm(ts.URL+"/m/named/learn", url.Values{"q": {"foo bar baz"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("POST /m/named/learn -> %v with the default model's journal failed, want %v", res.StatusCode, http.StatusOK)
+	}
+
+	var learned learnResponse
+	if code := postJSON(t, ts.URL+"/learn", `{"lines": ["foo bar quux"]}`, &learned); code != http.StatusInternalServerError {
+		t.Errorf("POST /learn JSON -> %v with a failed journal, want %v", code, http.StatusInternalServerError)
+	}
+
+	res, err = http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(body), "\nfate_journal_failed 1\n") {
+		t.Errorf("GET /metrics missing fate_journal_failed 1:\n%s", body)
+	}
+}
+
+func TestModels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fate-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	reg := newRegistry(dir, true)
+	ts := httptest.NewServer(newHandler(fate.NewModel(fate.Config{}), reg, defaultConfig()))
+	defer ts.Close()
+
+	for _, name := range []string{"one", "two"} {
+		args := url.Values{"q": {name + " bar baz"}}
+		res, err := http.PostForm(ts.URL+"/m/"+name+"/learn", args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("POST /m/%s/learn -> %v, want %v", name, res.StatusCode, http.StatusOK)
+		}
+	}
+
+	for _, name := range []string{"one", "two"} {
+		res, err := http.Get(ts.URL + "/m/" + name + "/reply?q=bar")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if want := name + " bar baz"; string(body) != want {
+			t.Errorf("GET /m/%s/reply -> %q, want %q", name, body, want)
+		}
+	}
+
+	for _, path := range []string{"/m/three/reply", "/m/one/other", "/m/bad.name/reply"} {
+		res, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusNotFound {
+			t.Errorf("GET %s -> %v, want %v", path, res.StatusCode, http.StatusNotFound)
+		}
+	}
+
+	res, err := http.Get(ts.URL + "/admin/models")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var list []modelInfo
+	if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if len(list) != 2 || list[0].Name != "one" || list[1].Name != "two" || list[0].Stats.Learned != 1 {
+		t.Fatalf("GET /admin/models -> %+v, want one and two", list)
+	}
+
+	if err := reg.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("DELETE", ts.URL+"/admin/models/two", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("DELETE /admin/models/two -> %v, want %v", res.StatusCode, http.StatusNoContent)
+	}
+
+	// Only the remaining model's snapshot is loaded again.
+	reloaded := newRegistry(dir, false)
+	if err := reloaded.Load(modelsConfig{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if names := reloaded.Names(); len(names) != 1 || names[0] != "one" {
+		t.Errorf("Load() -> %v, want [one]", names)
+	}
+}
+
+func TestModelsLimit(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.MaxModels = 1
+
+	ts := httptest.NewServer(newHandler(fate.NewModel(fate.Config{}), newRegistry("", true), cfg))
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		name string
+		code int
+	}{
+		{"one", http.StatusOK},
+		{"two", http.StatusServiceUnavailable},
+		{"one", http.StatusOK},
+	} {
+		res, err := http.PostForm(ts.URL+"/m/"+tc.name+"/learn", url.Values{"q": {"foo bar baz"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != tc.code {
+			t.Errorf("POST /m/%s/learn -> %v, want %v", tc.name, res.StatusCode, tc.code)
+		}
+	}
+}
+
+func TestModelsConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fate-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	corpus := filepath.Join(dir, "corpus.txt")
+	if err := ioutil.WriteFile(corpus, []byte("foo bar baz\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	config := filepath.Join(dir, "models.json")
+	text := `{"models": [{"name": "chan", "order": 4, "weighted": true, "corpus": [` + strconv.Quote(corpus) + `]}]}`
+	if err := ioutil.WriteFile(config, []byte(text), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := readModelsConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg := newRegistry("", false)
+	if err := reg.Load(c); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := reg.Get("chan", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reply := e.model.Reply("foo"); reply != "foo bar baz" {
+		t.Errorf("Reply(foo) -> %q, want %q", reply, "foo bar baz")
+	}
+
+	if _, err := reg.Get("other", true); err != errNoModel {
+		t.Errorf("Get(other) -> %v, want %v", err, errNoModel)
+	}
+
+	bad := `{"models": [{"name": "a/b"}]}`
+	if err := ioutil.WriteFile(config, []byte(bad), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := readModelsConfig(config); err == nil {
+		t.Errorf("readModelsConfig(%s) -> nil, want an error", bad)
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fate-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	corpus := filepath.Join(dir, "corpus.txt")
+	if err := ioutil.WriteFile(corpus, []byte("foo bar baz\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(dir, "config.json")
+	text := `{"addr": "unix:` + filepath.Join(dir, "sock") + `", "reply_timeout": "2s", "default_maxlen": 40, "corpus": [` + strconv.Quote(corpus) + `]}`
+	if err := ioutil.WriteFile(file, []byte(text), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := parseConfig("fate-server", []string{"-config", file, "-maxlen", "80", corpus})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Flags override the file, which overrides the defaults.
+	if cfg.DefaultMaxLen != 80 || time.Duration(cfg.ReplyTimeout) != 2*time.Second || time.Duration(cfg.ReadTimeout) != 5*time.Second {
+		t.Errorf("parseConfig() -> %+v, want maxlen 80, reply timeout 2s, read timeout 5s", cfg)
+	}
+
+	if network, _ := cfg.listenAddr(); network != "unix" {
+		t.Errorf("parseConfig() -> addr %q, want a unix socket", cfg.Addr)
+	}
+
+	if len(cfg.Corpus) != 2 {
+		t.Errorf("parseConfig() -> corpus %v, want the file's and the argument", cfg.Corpus)
+	}
+
+	_, err = parseConfig("fate-server", []string{"-addr", "localhost", "-reply-timeout", "0s", "-journal", "j", filepath.Join(dir, "missing.txt")})
+	errs, ok := err.(configError)
+	if !ok || len(errs) != 4 {
+		t.Errorf("parseConfig() -> %v, want 4 problems", err)
+	}
+
+	if _, err := parseConfig("fate-server", []string{"-reply-timeout", "soon", corpus}); err == nil {
+		t.Errorf("parseConfig(-reply-timeout soon) -> nil, want an error")
+	}
+
+	if err := ioutil.WriteFile(file, []byte(`{"adr": ":80"}`), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := parseConfig("fate-server", []string{"-config", file, corpus}); err == nil {
+		t.Errorf("parseConfig() with an unknown setting -> nil, want an error")
+	}
+}
+
+func TestConfigLimits(t *testing.T) {
+	model := fate.NewModel(fate.Config{})
+	model.Learn("foo bar baz")
+	model.Learn("foo bar baz quux quuux quuuux")
+
+	cfg := defaultConfig()
+	cfg.MaxLearnBytes = 16
+	cfg.DefaultMaxLen = 11
+
+	ts := httptest.NewServer(newHandler(model, nil, cfg))
+	defer ts.Close()
+
+	res, err := http.PostForm(ts.URL+"/learn", url.Values{"q": {"this line is far too long to learn"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("POST /learn -> %v, want %v", res.StatusCode, http.StatusRequestEntityTooLarge)
+	}
+
+	for i := 0; i < 20; i++ {
+		res, err := http.Get(ts.URL + "/reply?q=foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if string(body) != "foo bar baz" {
+			t.Fatalf("GET /reply?q=foo -> %q, want %q", body, "foo bar baz")
+		}
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fate-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := defaultConfig()
+	cfg.Addr = "unix:" + filepath.Join(dir, "sock")
+
+	ln, err := cfg.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	if ln.Addr().Network() != "unix" {
+		t.Errorf("listen() -> %v, want a unix socket", ln.Addr())
+	}
+}
+
+func do(t *testing.T, method, url, token string, body url.Values) *http.Response {
+	req, err := http.NewRequest(method, url, strings.NewReader(body.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	return res
+}
+
+func TestAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fate-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "tokens")
+	text := "# clients\nreader read\nwriter read,write\n"
+	if err := ioutil.WriteFile(file, []byte(text), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	tokens, err := readTokens(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := defaultConfig()
+	cfg.tokens = tokens
+
+	model := fate.NewModel(fate.Config{})
+	ts := httptest.NewServer(newHandler(model, newRegistry("", true), cfg))
+	defer ts.Close()
+
+	learn := url.Values{"q": {"foo bar baz"}}
+
+	tests := []struct {
+		method, path, token string
+		code                int
+	}{
+		{"POST", "/learn", "", http.StatusUnauthorized},
+		{"POST", "/learn", "wrong", http.StatusUnauthorized},
+		{"POST", "/learn", "reader", http.StatusForbidden},
+		{"POST", "/m/chan/learn", "reader", http.StatusForbidden},
+		{"POST", "/learn", "writer", http.StatusOK},
+		{"GET", "/reply?q=foo", "", http.StatusUnauthorized},
+		{"GET", "/reply?q=foo", "reader", http.StatusOK},
+		{"GET", "/admin/models", "reader", http.StatusForbidden},
+		{"GET", "/admin/models", "writer", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		res := do(t, tt.method, ts.URL+tt.path, tt.token, learn)
+		if res.StatusCode != tt.code {
+			t.Errorf("%s %s with %q -> %v, want %v", tt.method, tt.path, tt.token, res.StatusCode, tt.code)
+		}
+
+		if res.StatusCode == http.StatusUnauthorized && res.Header.Get("WWW-Authenticate") == "" {
+			t.Errorf("%s %s -> no WWW-Authenticate header", tt.method, tt.path)
+		}
+	}
+
+	res, err := http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("GET /metrics -> %v, want %v", res.StatusCode, http.StatusUnauthorized)
+	}
+
+	if _, err := readTokens(file + ".missing"); err == nil {
+		t.Errorf("readTokens(missing) -> nil, want an error")
+	}
+
+	if err := ioutil.WriteFile(file, []byte("token admin\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := readTokens(file); err == nil {
+		t.Errorf("readTokens(admin scope) -> nil, want an error")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	model := fate.NewModel(fate.Config{})
+	model.Learn("foo bar baz")
+
+	cfg := defaultConfig()
+	cfg.RateLimit = 1
+	cfg.RateBurst = 2
+
+	ts := httptest.NewServer(newHandler(model, nil, cfg))
+	defer ts.Close()
+
+	learn := url.Values{"q": {"foo bar baz"}}
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		res := do(t, "POST", ts.URL+"/learn", "", learn)
+		if res.StatusCode != want {
+			t.Fatalf("POST /learn #%d -> %v, want %v", i, res.StatusCode, want)
+		}
+
+		if want == http.StatusTooManyRequests && res.Header.Get("Retry-After") != "1" {
+			t.Errorf("POST /learn -> Retry-After %q, want 1", res.Header.Get("Retry-After"))
+		}
+	}
+
+	// Replies have their own bucket.
+	if res := do(t, "GET", ts.URL+"/reply?q=foo", "", nil); res.StatusCode != http.StatusOK {
+		t.Errorf("GET /reply -> %v, want %v", res.StatusCode, http.StatusOK)
+	}
+
+	res, err := http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if !strings.Contains(string(body), `fate_learn_rejected_total{reason="rate_limited"} 1`) {
+		t.Errorf("GET /metrics didn't count the rate limited learn:\n%s", body)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter(2, 1)
+	now := time.Unix(0, 0)
+
+	if ok, _ := l.Allow("a", now); !ok {
+		t.Fatalf("Allow(a) -> false, want true")
+	}
+
+	ok, wait := l.Allow("a", now)
+	if ok || wait != 500*time.Millisecond {
+		t.Fatalf("Allow(a) -> %v, %v, want false, 500ms", ok, wait)
+	}
+
+	if ok, _ := l.Allow("b", now); !ok {
+		t.Errorf("Allow(b) -> false, want true")
+	}
+
+	if ok, _ := l.Allow("a", now.Add(500*time.Millisecond)); !ok {
+		t.Errorf("Allow(a) after refilling -> false, want true")
+	}
+}
+
+// writeCert writes a certificate for name and its key to dir, signed
+// by parent, or self-signed if parent is nil.
+func writeCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		parent, parentKey = tmpl, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]*pem.Block{
+		name + ".crt": {Type: "CERTIFICATE", Bytes: der},
+		name + ".key": {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	}
+	for file, block := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return cert, key
+}
+
+func TestTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fate-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, caKey := writeCert(t, dir, "ca", nil, nil)
+	writeCert(t, dir, "server", ca, caKey)
+	writeCert(t, dir, "client", ca, caKey)
+
+	path := func(file string) string { return filepath.Join(dir, file) }
+
+	cfg := defaultConfig()
+	cfg.TLSCert, cfg.TLSKey, cfg.TLSClientCA = path("server.crt"), path("server.key"), path("ca.crt")
+	cfg.Corpus = []string{path("ca.crt")}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	model := fate.NewModel(fate.Config{})
+	model.Learn("foo bar baz")
+
+	certs := cfg.certs
+
+	ts := httptest.NewUnstartedServer(newHandler(model, nil, cfg))
+	ts.TLS = certs.Config()
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	client := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: roots, Certificates: certs},
+			DisableKeepAlives: true,
+		}}
+	}
+
+	clientCert, err := tls.LoadX509KeyPair(path("client.crt"), path("client.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	learn := url.Values{"q": {"foo bar quux"}}
+
+	tests := []struct {
+		cert bool
+		path string
+		code int
+	}{
+		{false, "/learn", http.StatusForbidden},
+		{false, "/reply", http.StatusOK},
+		{true, "/learn", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		c := client()
+		if tt.cert {
+			c = client(clientCert)
+		}
+
+		res, err := c.PostForm(ts.URL+tt.path, learn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != tt.code {
+			t.Errorf("POST %s (client cert %v) -> %d, want %d", tt.path, tt.cert, res.StatusCode, tt.code)
+		}
+	}
+
+	cfg = defaultConfig()
+	cfg.TLSCert, cfg.TLSClientCA, cfg.Corpus = path("server.crt"), path("ca.crt"), []string{path("ca.crt")}
+	if err := cfg.validate(); err == nil {
+		t.Error("validate() with tls_cert and no tls_key succeeded")
+	}
+
+	// A new certificate is served after a reload.
+	serverName := func() string {
+		res, err := client().Get(ts.URL + "/reply?q=foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.TLS.PeerCertificates[0].Subject.CommonName
+	}
+
+	if name := serverName(); name != "server" {
+		t.Fatalf("server certificate %q, want server", name)
+	}
+
+	writeCert(t, dir, "renewed", ca, caKey)
+	os.Rename(path("renewed.crt"), path("server.crt"))
+	os.Rename(path("renewed.key"), path("server.key"))
+
+	if err := certs.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if name := serverName(); name != "renewed" {
+		t.Errorf("server certificate after reload %q, want renewed", name)
+	}
+
+	// A bad reload keeps the old certificate.
+	ioutil.WriteFile(path("server.key"), []byte("garbage"), 0600)
+	if err := certs.Reload(); err == nil {
+		t.Error("Reload() with a bad key succeeded")
+	}
+	if name := serverName(); name != "renewed" {
+		t.Errorf("server certificate after a bad reload %q, want renewed", name)
+	}
+}
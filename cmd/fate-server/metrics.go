@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the reply latency histogram,
+// in seconds.
+var latencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5}
+
+// metrics counts server activity for /metrics, in the Prometheus text
+// exposition format.
+type metrics struct {
+	lock sync.Mutex
+
+	// requests counts requests by endpoint and status code.
+	requests map[request]int64
+
+	// latency holds reply latency counts per bucket, with one more
+	// for +Inf.
+	latency    []int64
+	latencySum float64
+
+	// maxlen counts replies constrained by maxlen, by whether one
+	// fit. The search for a fitting reply replaces retrying until
+	// one is short enough.
+	maxlen map[string]int64
+
+	timeouts int64
+
+	// rejected counts learns refused, by reason.
+	rejected map[string]int64
+}
+
+type request struct {
+	endpoint string
+	code     int
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests: make(map[request]int64),
+		latency:  make([]int64, len(latencyBuckets)+1),
+		maxlen:   make(map[string]int64),
+		rejected: make(map[string]int64),
+	}
+}
+
+// instrument wraps an endpoint's handler to count its requests by
+// status code.
+func (m *metrics) instrument(endpoint string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		h(rec, req)
+
+		m.lock.Lock()
+		m.requests[request{endpoint, rec.code}]++
+		m.lock.Unlock()
+	}
+}
+
+func (m *metrics) observeReply(elapsed time.Duration) {
+	secs := elapsed.Seconds()
+	i := sort.SearchFloat64s(latencyBuckets, secs)
+
+	m.lock.Lock()
+	m.latency[i]++
+	m.latencySum += secs
+	m.lock.Unlock()
+}
+
+func (m *metrics) observeMaxlen(result string) {
+	m.lock.Lock()
+	m.maxlen[result]++
+	m.lock.Unlock()
+}
+
+// observeRejectedLearn counts n lines or requests not learned.
+func (m *metrics) observeRejectedLearn(reason string, n int) {
+	m.lock.Lock()
+	m.rejected[reason] += int64(n)
+	m.lock.Unlock()
+}
+
+func (m *metrics) observeTimeout() {
+	m.lock.Lock()
+	m.timeouts++
+	m.lock.Unlock()
+}
+
+func (h handler) serveMetrics(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	// Read the model first, so its lock isn't held with ours.
+	stats := h.model.Stats()
+
+	m := h.metrics
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var reqs []request
+	for r := range m.requests {
+		reqs = append(reqs, r)
+	}
+	sort.Slice(reqs, func(i, j int) bool {
+		if reqs[i].endpoint != reqs[j].endpoint {
+			return reqs[i].endpoint < reqs[j].endpoint
+		}
+		return reqs[i].code < reqs[j].code
+	})
+
+	header(w, "fate_requests_total", "counter", "Requests by endpoint and status code.")
+	for _, r := range reqs {
+		fmt.Fprintf(w, "fate_requests_total{endpoint=%q,code=\"%d\"} %d\n", r.endpoint, r.code, m.requests[r])
+	}
+
+	header(w, "fate_reply_duration_seconds", "histogram", "Time spent generating replies.")
+	var count int64
+	for i, le := range latencyBuckets {
+		count += m.latency[i]
+		fmt.Fprintf(w, "fate_reply_duration_seconds_bucket{le=%q} %d\n", formatFloat(le), count)
+	}
+	count += m.latency[len(latencyBuckets)]
+	fmt.Fprintf(w, "fate_reply_duration_seconds_bucket{le=\"+Inf\"} %d\n", count)
+	fmt.Fprintf(w, "fate_reply_duration_seconds_sum %s\n", formatFloat(m.latencySum))
+	fmt.Fprintf(w, "fate_reply_duration_seconds_count %d\n", count)
+
+	header(w, "fate_reply_maxlen_total", "counter", "Replies constrained by maxlen, by whether one fit.")
+	for _, result := range []string{"fit", "nofit"} {
+		fmt.Fprintf(w, "fate_reply_maxlen_total{result=%q} %d\n", result, m.maxlen[result])
+	}
+
+	header(w, "fate_reply_timeouts_total", "counter", "Replies that timed out.")
+	fmt.Fprintf(w, "fate_reply_timeouts_total %d\n", m.timeouts)
+
+	header(w, "fate_learn_rejected_total", "counter", "Learn requests or lines refused, by reason.")
+	for _, reason := range []string{"forbidden", "rate_limited", "too_short", "unauthorized"} {
+		fmt.Fprintf(w, "fate_learn_rejected_total{reason=%q} %d\n", reason, m.rejected[reason])
+	}
+
+	header(w, "fate_model_tokens", "gauge", "Distinct words in the model, counting the start and end of sentence markers.")
+	fmt.Fprintf(w, "fate_model_tokens %d\n", stats.Tokens)
+
+	header(w, "fate_model_contexts", "gauge", "Distinct contexts in the model, by length.")
+	fmt.Fprintf(w, "fate_model_contexts{length=\"2\"} %d\n", stats.Bigrams)
+	if stats.Contexts > 0 {
+		fmt.Fprintf(w, "fate_model_contexts{length=\"3+\"} %d\n", stats.Contexts)
+	}
+
+	header(w, "fate_model_trigrams", "gauge", "Distinct trigrams in the model.")
+	fmt.Fprintf(w, "fate_model_trigrams %d\n", stats.Trigrams)
+
+	header(w, "fate_model_memory_bytes", "gauge", "Approximate memory used by the model.")
+	fmt.Fprintf(w, "fate_model_memory_bytes %d\n", stats.MemoryBytes)
+
+	if h.journal != nil {
+		failed := 0
+		if h.journal.Err() != nil {
+			failed = 1
+		}
+
+		header(w, "fate_journal_failed", "gauge", "Whether the journal has stopped recording learned lines.")
+		fmt.Fprintf(w, "fate_journal_failed %d\n", failed)
+	}
+}
+
+func header(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// statusRecorder remembers the status code written to a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Flush lets streamed replies through the recorder.
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pteichman/fate"
+)
+
+// validName matches model names. They're used in file names, so
+// they're kept simple.
+var validName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// modelsConfig describes the named models a server starts with.
+type modelsConfig struct {
+	Models []modelConfig `json:"models"`
+}
+
+type modelConfig struct {
+	Name     string   `json:"name"`
+	Order    int      `json:"order"`
+	Weighted bool     `json:"weighted"`
+	Corpus   []string `json:"corpus"`
+}
+
+func (c modelConfig) config() fate.Config {
+	return fate.Config{Order: c.Order, Weighted: c.Weighted}
+}
+
+func readModelsConfig(path string) (modelsConfig, error) {
+	var c modelsConfig
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+
+	if err := json.Unmarshal(buf, &c); err != nil {
+		return c, fmt.Errorf("%s: %s", path, err)
+	}
+
+	if err := validateModels(c.Models); err != nil {
+		return c, fmt.Errorf("%s: %s", path, err)
+	}
+
+	return c, nil
+}
+
+func validateModels(models []modelConfig) error {
+	seen := make(map[string]bool)
+	for _, m := range models {
+		if !validName.MatchString(m.Name) {
+			return fmt.Errorf("invalid model name %q", m.Name)
+		}
+		if seen[m.Name] {
+			return fmt.Errorf("duplicate model name %q", m.Name)
+		}
+		if m.Order != 0 && (m.Order < 3 || m.Order > fate.MaxOrder) {
+			return fmt.Errorf("model %q order %d out of range [3, %d]", m.Name, m.Order, fate.MaxOrder)
+		}
+		seen[m.Name] = true
+	}
+
+	return nil
+}
+
+// registry holds the named models served under /m/{name}/. Each has
+// its own snapshot file in dir, if there is one.
+type registry struct {
+	lock    sync.Mutex
+	models  map[string]*entry
+	configs map[string]fate.Config
+
+	// dir holds the models' snapshots, or is empty to keep them in
+	// memory only.
+	dir string
+
+	// lazy creates models the first time something is learned
+	// under their name.
+	lazy bool
+
+	metrics *metrics
+	cfg     *config
+	gate    *gate
+}
+
+// entry is a named model. Its lock keeps snapshots and deletion from
+// overlapping.
+type entry struct {
+	lock    sync.Mutex
+	name    string
+	model   *fate.Model
+	snap    *snapshotter
+	deleted bool
+
+	// loaded is set if the model was read from a snapshot.
+	loaded bool
+}
+
+var (
+	errNoModel       = errors.New("no such model")
+	errTooManyModels = errors.New("too many models")
+)
+
+func newRegistry(dir string, lazy bool) *registry {
+	return &registry{
+		models:  make(map[string]*entry),
+		configs: make(map[string]fate.Config),
+		dir:     dir,
+		lazy:    lazy,
+	}
+}
+
+// Load creates the models in c, and any others with snapshots in the
+// registry's directory. Models with snapshots are read from them;
+// others learn their corpus files.
+func (r *registry) Load(c modelsConfig) error {
+	for _, mc := range c.Models {
+		r.configs[mc.Name] = mc.config()
+
+		e, err := r.open(mc.Name, 0)
+		if err != nil {
+			return err
+		}
+
+		if e.loaded {
+			continue
+		}
+
+		for _, f := range mc.Corpus {
+			if err := learnFile(e.model, f); err != nil {
+				return err
+			}
+		}
+	}
+
+	if r.dir == "" {
+		return nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(r.dir, "*.fate"))
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		name := strings.TrimSuffix(filepath.Base(f), ".fate")
+		if !validName.MatchString(name) {
+			continue
+		}
+
+		if _, err := r.open(name, 0); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *registry) path(name string) string {
+	if r.dir == "" {
+		return ""
+	}
+
+	return filepath.Join(r.dir, name+".fate")
+}
+
+// open returns the model called name, loading it from its snapshot or
+// creating it if necessary. If max isn't zero, a model is only added
+// while the registry has fewer than max.
+func (r *registry) open(name string, max int) (*entry, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if e, ok := r.models[name]; ok {
+		return e, nil
+	}
+
+	if max > 0 && len(r.models) >= max {
+		return nil, errTooManyModels
+	}
+
+	path := r.path(name)
+
+	m, loaded, err := loadModel(path, r.configs[name])
+	if err != nil {
+		return nil, fmt.Errorf("loading %s: %s", path, err)
+	}
+
+	e := &entry{name: name, model: m, loaded: loaded}
+	if path != "" {
+		e.snap = newSnapshotter(m, path, nil)
+	}
+
+	r.models[name] = e
+	return e, nil
+}
+
+// Get returns the model called name. If create is set and the
+// registry is lazy, missing models are created, up to the config's
+// MaxModels.
+func (r *registry) Get(name string, create bool) (*entry, error) {
+	r.lock.Lock()
+	e, ok := r.models[name]
+	r.lock.Unlock()
+
+	if ok {
+		return e, nil
+	}
+
+	_, configured := r.configs[name]
+	if !create || !(r.lazy || configured) {
+		return nil, errNoModel
+	}
+
+	max := 0
+	if !configured {
+		max = r.cfg.MaxModels
+	}
+
+	return r.open(name, max)
+}
+
+// Delete removes the model called name, and its snapshot. The registry
+// stays locked until the snapshot is gone, so the model can't be
+// loaded from it again in the meantime.
+func (r *registry) Delete(name string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	e, ok := r.models[name]
+	if !ok {
+		return errNoModel
+	}
+	delete(r.models, name)
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.deleted = true
+
+	if path := r.path(name); path != "" {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Names returns the names of the registry's models, sorted.
+func (r *registry) Names() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	names := make([]string, 0, len(r.models))
+	for name := range r.models {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Save snapshots every model that's changed since its last snapshot.
+func (r *registry) Save() error {
+	if r.dir == "" {
+		return nil
+	}
+
+	r.lock.Lock()
+	entries := make([]*entry, 0, len(r.models))
+	for _, e := range r.models {
+		entries = append(entries, e)
+	}
+	r.lock.Unlock()
+
+	var first error
+	for _, e := range entries {
+		if err := e.save(); err != nil {
+			log.Printf("Saving %s: %s\n", e.name, err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+
+	return first
+}
+
+func (e *entry) save() error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.deleted {
+		return nil
+	}
+
+	return e.snap.Save()
+}
+
+// modelActions maps the paths under /m/{name}/ to the endpoints
+// they're counted and rate limited as.
+var modelActions = map[string]struct{ endpoint, limit string }{
+	"learn":        {"learn", "learn"},
+	"reply":        {"reply", "reply"},
+	"reply/stream": {"reply_stream", "reply"},
+}
+
+// ServeHTTP serves /m/{name}/learn, /m/{name}/reply and
+// /m/{name}/reply/stream.
+func (r *registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/m/"), "/", 2)
+	if len(parts) != 2 || !validName.MatchString(parts[0]) {
+		http.NotFound(w, req)
+		return
+	}
+
+	name, action := parts[0], parts[1]
+	a, ok := modelActions[action]
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+
+	sc := scopeRead
+	if action == "learn" {
+		sc = scopeWrite
+	}
+
+	r.metrics.instrument(a.endpoint, r.gate.wrap(sc, a.limit, func(w http.ResponseWriter, req *http.Request) {
+		r.serveModel(w, req, name, action)
+	}))(w, req)
+}
+
+func (r *registry) serveModel(w http.ResponseWriter, req *http.Request, name, action string) {
+	e, err := r.Get(name, action == "learn" && req.Method == "POST")
+	if err != nil {
+		code := http.StatusInternalServerError
+		switch err {
+		case errNoModel:
+			code = http.StatusNotFound
+		case errTooManyModels:
+			code = http.StatusServiceUnavailable
+		}
+
+		if isJSON(req) {
+			jsonError(w, code, fmt.Sprintf("Model %q: %s", name, err))
+		} else {
+			http.Error(w, fmt.Sprintf("Model %q: %s", name, err), code)
+		}
+		return
+	}
+
+	// Named models have no journal.
+	h := handler{model: e.model, metrics: r.metrics, cfg: r.cfg}
+	switch action {
+	case "learn":
+		h.learn(w, req)
+	case "reply":
+		h.reply(w, req)
+	case "reply/stream":
+		h.replyStream(w, req)
+	}
+}
+
+type modelInfo struct {
+	Name  string     `json:"name"`
+	Stats fate.Stats `json:"stats"`
+}
+
+// serveAdmin lists models at /admin/models and deletes them at
+// /admin/models/{name}.
+func (r *registry) serveAdmin(w http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/admin/models"), "/")
+
+	switch {
+	case name == "" && req.Method == "GET":
+		list := []modelInfo{}
+		for _, name := range r.Names() {
+			if e, err := r.Get(name, false); err == nil {
+				list = append(list, modelInfo{Name: name, Stats: e.model.Stats()})
+			}
+		}
+		writeJSON(w, http.StatusOK, list)
+	case name != "" && req.Method == "DELETE":
+		err := r.Delete(name)
+		switch {
+		case err == errNoModel:
+			jsonError(w, http.StatusNotFound, fmt.Sprintf("Model %q: %s", name, err))
+		case err != nil:
+			jsonError(w, http.StatusInternalServerError, err.Error())
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		jsonError(w, http.StatusMethodNotAllowed, "Invalid request method")
+	}
+}
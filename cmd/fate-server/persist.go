@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pteichman/fate"
+)
+
+// loadModel reads a model snapshot from path, reporting whether there
+// was one. No path, or a missing file, gets an empty model, so a new
+// server can start with a snapshot path that doesn't exist yet.
+func loadModel(path string, opts fate.Config) (*fate.Model, bool, error) {
+	if path == "" {
+		return fate.NewModel(opts), false, nil
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return fate.NewModel(opts), false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	m, err := fate.ReadModel(f, opts)
+	return m, err == nil, err
+}
+
+// saveModel writes a snapshot of m to path. It writes to a temporary
+// file in the same directory and renames it into place, so a crash
+// never leaves a partial snapshot behind.
+func saveModel(m *fate.Model, path string) error {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+
+	f, err := ioutil.TempFile(dir, base+".tmp*")
+	if err != nil {
+		return err
+	}
+
+	tmp := f.Name()
+	cleanup := func(err error) error {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if _, err := m.WriteTo(f); err != nil {
+		return cleanup(err)
+	}
+
+	if err := f.Sync(); err != nil {
+		return cleanup(err)
+	}
+
+	if err := f.Close(); err != nil {
+		return cleanup(err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+// snapshotter saves a model periodically, skipping snapshots when
+// nothing has been learned or forgotten since the last one. If the
+// model has a journal, saving compacts it into the snapshot.
+type snapshotter struct {
+	model   *fate.Model
+	path    string
+	journal *fate.Journal
+
+	// changes is the model's Learned+Forgot count at the last
+	// snapshot. It starts at zero, the count of a model just loaded
+	// or created, so whatever it's learned since is saved.
+	changes int64
+}
+
+// newSnapshotter returns a snapshotter for m, a model as loadModel
+// returned it, whose snapshot is at path.
+func newSnapshotter(m *fate.Model, path string, j *fate.Journal) *snapshotter {
+	return &snapshotter{model: m, path: path, journal: j}
+}
+
+func modelChanges(m *fate.Model) int64 {
+	s := m.Activity()
+	return s.Learned + s.Forgot
+}
+
+// Save writes a snapshot if the model has changed.
+func (s *snapshotter) Save() error {
+	changes := modelChanges(s.model)
+	if changes == s.changes {
+		return nil
+	}
+
+	var err error
+	if s.journal != nil && s.journal.Err() == nil {
+		err = s.journal.Compact(s.model, s.path)
+	} else {
+		if s.journal != nil {
+			// Lines learned since the journal failed are only
+			// in memory; get them into a snapshot.
+			log.Printf("Journal failed, saving snapshot without it: %s\n", s.journal.Err())
+		}
+		err = saveModel(s.model, s.path)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	s.changes = changes
+	return nil
+}
+
+// saver is something that can be snapshotted: a single model or a
+// registry of them.
+type saver interface {
+	Save() error
+}
+
+// saveEvery saves s every interval until ctx is done.
+func saveEvery(ctx context.Context, s saver, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Save(); err != nil {
+				log.Printf("Saving snapshot: %s\n", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/pteichman/fate"
+)
+
+// streamBuffer is how many words a reply can get ahead of a slow
+// client. The model's read lock is held while the reply is walked, so
+// the walk shouldn't wait on the network.
+const streamBuffer = 64
+
+type tokenEvent struct {
+	Token string `json:"token"`
+}
+
+type doneEvent struct {
+	Reply string `json:"reply"`
+}
+
+// replyStream serves a reply to q as Server-Sent Events: a token event
+// for each word as it's generated, then a done event with the whole
+// reply, or an error event if generation fails partway.
+func (h handler) replyStream(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), time.Duration(h.cfg.ReplyTimeout))
+	defer cancel()
+
+	q := req.FormValue("q")
+
+	type result struct {
+		reply string
+		err   error
+	}
+
+	words := make(chan string, streamBuffer)
+	done := make(chan result, 1)
+
+	go func() {
+		defer close(words)
+
+		start := time.Now()
+		reply, err := h.model.ReplyStream(ctx, q, func(word string) error {
+			select {
+			case words <- word:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		h.metrics.observeReply(time.Since(start))
+
+		if err == context.DeadlineExceeded || err == context.Canceled {
+			h.metrics.observeTimeout()
+		}
+
+		done <- result{reply, err}
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for word := range words {
+		writeEvent(w, "token", tokenEvent{Token: word})
+		flusher.Flush()
+	}
+
+	r := <-done
+	if r.err != nil {
+		code, msg := replyError(r.err)
+		writeEvent(w, "error", errorBody{Code: code, Message: msg})
+	} else {
+		writeEvent(w, "done", doneEvent{Reply: fate.QuoteFix(r.reply)})
+	}
+	flusher.Flush()
+}
+
+// writeEvent writes a Server-Sent Event with v as its JSON data.
+func writeEvent(w io.Writer, event string, v interface{}) {
+	data, _ := json.Marshal(v)
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+// certs holds the server's TLS certificate and the CAs its clients'
+// certificates are checked against, and reloads them from their files.
+type certs struct {
+	certFile, keyFile, caFile string
+
+	lock sync.RWMutex
+	cert *tls.Certificate
+	cas  *x509.CertPool
+}
+
+func newCerts(certFile, keyFile, caFile string) (*certs, error) {
+	c := &certs{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Reload reads the certificate, key and CA bundle again. If any of them
+// is bad, the ones already loaded are kept.
+func (c *certs) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	var cas *x509.CertPool
+	if c.caFile != "" {
+		if cas, err = readCAs(c.caFile); err != nil {
+			return err
+		}
+	}
+
+	c.lock.Lock()
+	c.cert, c.cas = &cert, cas
+	c.lock.Unlock()
+
+	return nil
+}
+
+func readCAs(path string) (*x509.CertPool, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cas := x509.NewCertPool()
+	if !cas.AppendCertsFromPEM(buf) {
+		return nil, fmt.Errorf("%s: no certificates found", path)
+	}
+
+	return cas, nil
+}
+
+// Config returns a TLS config that always uses the latest certificates.
+// With a CA bundle, clients may present certificates; writes require
+// one, but replies don't.
+func (c *certs) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c.lock.RLock()
+			defer c.lock.RUnlock()
+
+			cfg := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*c.cert},
+			}
+
+			if c.cas != nil {
+				cfg.ClientAuth = tls.VerifyClientCertIfGiven
+				cfg.ClientCAs = c.cas
+			}
+
+			return cfg, nil
+		},
+	}
+}
+
+// verifiedClient reports whether req came over TLS with a client
+// certificate signed by one of the server's CAs.
+func verifiedClient(req *http.Request) bool {
+	return req.TLS != nil && len(req.TLS.VerifiedChains) > 0
+}
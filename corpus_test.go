@@ -1,7 +1,9 @@
 package fate
 
 import (
+	"context"
 	"math/rand"
+	"reflect"
 	"strings"
 	"sync/atomic"
 	"testing"
@@ -117,6 +119,27 @@ func BenchmarkLearnParallel(b *testing.B) {
 	})
 }
 
+func BenchmarkLearnAll(b *testing.B) {
+	sentences := corpus(vocab(100000), b.N, func() int {
+		return clamp(gauss(10, 5))
+	})
+
+	model := NewModel(Config{})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	lines := make(chan string, 1024)
+	go func() {
+		for _, sen := range sentences {
+			lines <- sen
+		}
+		reflect.ValueOf(lines).Close()
+	}()
+
+	model.LearnAll(context.Background(), lines, 0)
+}
+
 func BenchmarkReplyParallel(b *testing.B) {
 	sentences := corpus(vocab(100000), b.N, func() int {
 		return clamp(gauss(10, 5))
@@ -138,3 +161,27 @@ func BenchmarkReplyParallel(b *testing.B) {
 		}
 	})
 }
+
+func BenchmarkReplyFrozenParallel(b *testing.B) {
+	sentences := corpus(vocab(100000), b.N, func() int {
+		return clamp(gauss(10, 5))
+	})
+
+	model := NewModel(Config{})
+	for _, sen := range sentences {
+		model.Learn(sen)
+	}
+
+	frozen := model.Freeze()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		var i int
+		for pb.Next() {
+			frozen.Reply(sentences[i%len(sentences)])
+			i++
+		}
+	})
+}
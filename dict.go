@@ -26,6 +26,24 @@ func (d *dict) ID(w string) token {
 	return id
 }
 
+// Append adds w with the next id, without checking whether it
+// already has one. Empty words are retired ids and aren't indexed.
+func (d *dict) Append(w string) token {
+	id := token(len(d.words))
+	d.words = append(d.words, w)
+	if w != "" {
+		d.ids[w] = id
+	}
+	return id
+}
+
+// Remove retires tok's id. Its word is forgotten and will get a new id
+// if it's seen again.
+func (d *dict) Remove(tok token) {
+	delete(d.ids, d.words[tok])
+	d.words[tok] = ""
+}
+
 func (d *dict) Word(tok token) string {
 	return d.words[tok]
 }
@@ -36,9 +54,17 @@ type syndict struct {
 
 	syns    map[string]*tokset2
 	stemmer Stemmer
+
+	// table, if set, holds the dictionary of a model opened by
+	// OpenFrozen in place of d and syns. It can't be changed.
+	table *wordTable
 }
 
 func (s *syndict) CheckID(word string) (token, bool) {
+	if s.table != nil {
+		return s.table.id(word)
+	}
+
 	tok, ok := s.d.CheckID(word)
 	return tok, ok
 }
@@ -64,16 +90,41 @@ func (s *syndict) ID(word string) token {
 	return tok
 }
 
+// Remove retires tok and drops it from its synonyms.
+func (s *syndict) Remove(tok token) {
+	key := s.stemmer.Stem(s.d.Word(tok))
+	if toks, ok := s.syns[key]; ok {
+		toks.Remove(tok)
+		if len(toks.Tokens()) == 0 {
+			delete(s.syns, key)
+		}
+	}
+
+	s.d.Remove(tok)
+}
+
 func (s *syndict) Len() int {
+	if s.table != nil {
+		return s.table.len()
+	}
+
 	return len(s.d.words)
 }
 
 func (s *syndict) Syns(word string) []token {
 	key := s.stemmer.Stem(word)
+	if s.table != nil {
+		return s.table.syns(key)
+	}
+
 	return s.syns[key].Tokens()
 }
 
 func (s *syndict) Word(tok token) string {
+	if s.table != nil {
+		return string(s.table.word(tok))
+	}
+
 	return s.d.Word(tok)
 }
 
@@ -84,3 +135,22 @@ func newSyndict(s Stemmer) *syndict {
 		stemmer: s,
 	}
 }
+
+// clone returns a copy of s that doesn't share anything with it.
+func (s *syndict) clone() *syndict {
+	d := &dict{
+		words: make([]string, len(s.d.words)),
+		ids:   make(map[string]token, len(s.d.ids)),
+	}
+	copy(d.words, s.d.words)
+	for w, tok := range s.d.ids {
+		d.ids[w] = tok
+	}
+
+	syns := make(map[string]*tokset2, len(s.syns))
+	for key, toks := range s.syns {
+		syns[key] = &tokset2{t: append([]token(nil), toks.t...)}
+	}
+
+	return &syndict{d: d, syns: syns, stemmer: s.stemmer}
+}
@@ -55,7 +55,7 @@ func TestSyndict(t *testing.T) {
 
 		res := d.Syns(tt.query)
 		if !reflect.DeepEqual(res, tt.expected.Tokens()) {
-			t.Errorf("[%d] Get(%q) => %d, want %d", ti, tt.query, res, tt.expected)
+			t.Errorf("[%d] Get(%q) => %d, want %d", ti, tt.query, res, tt.expected.Tokens())
 		}
 	}
 }
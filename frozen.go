@@ -0,0 +1,282 @@
+package fate
+
+import (
+	"context"
+	"sort"
+	"sync/atomic"
+)
+
+// FrozenModel is a read-only copy of a Model, for serving replies
+// after learning is done. Its chains are kept in sorted, contiguous
+// arrays rather than maps of pointers, so it uses less memory and
+// gives the garbage collector nothing to scan, and it replies without
+// locking.
+//
+// A FrozenModel generates exactly what its Model would have: given the
+// same random choices, they reply identically.
+type FrozenModel struct {
+	m *Model
+
+	// close unmaps a model opened by OpenFrozen.
+	close func() error
+}
+
+// Freeze returns a FrozenModel with everything m has learned. m can
+// go on learning without changing it.
+func (m *Model) Freeze() *FrozenModel {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return &FrozenModel{m: m.freeze()}
+}
+
+// freeze is Freeze, for callers holding m's lock. It returns the frozen
+// model's inner Model.
+func (m *Model) freeze() *Model {
+	f := &frozenChains{tokens: m.bi.len()}
+
+	for tok := 0; tok < m.tokens.Len(); tok++ {
+		f.next.add(m.bi.get(token(tok)))
+	}
+	f.next.trim()
+
+	f.tri = make([]bigram, 0, m.tri.len())
+	m.tri.each(func(ctx bigram, _ *fwdrev) {
+		f.tri = append(f.tri, ctx)
+	})
+	sort.Slice(f.tri, func(i, j int) bool { return f.tri[i].less(f.tri[j]) })
+
+	for _, ctx := range f.tri {
+		chain := m.tri.get(ctx)
+		f.triChains.add(&chain.fwd)
+		f.triChains.add(&chain.rev)
+	}
+	f.triChains.trim()
+
+	f.hi = make([]frozenLevel, len(m.hi))
+	for i := range m.hi {
+		level, fl := &m.hi[i], &f.hi[i]
+
+		fl.ctxs = make([]ngram, 0, level.len())
+		level.each(func(ctx ngram, _ *fwdrev) {
+			fl.ctxs = append(fl.ctxs, ctx)
+		})
+		sort.Slice(fl.ctxs, func(i, j int) bool { return fl.ctxs[i].less(fl.ctxs[j]) })
+
+		for _, ctx := range fl.ctxs {
+			chain := level.get(ctx)
+			fl.chains.add(&chain.fwd)
+			fl.chains.add(&chain.rev)
+		}
+		fl.chains.trim()
+	}
+
+	return &Model{
+		tokens:   m.tokens.clone(),
+		startTok: m.startTok,
+		endTok:   m.endTok,
+
+		// The walks only need hi's length to know the order; its
+		// contexts are in f.
+		hi:      make([]ngrams, len(m.hi)),
+		order:   m.order,
+		backoff: m.backoff,
+
+		weighted: m.weighted,
+		maxPath:  m.maxPath,
+
+		tokenizer:   m.tokenizer,
+		detokenizer: m.detokenizer,
+
+		chains: f,
+
+		rand:  &prng{atomic.LoadUint64(&m.rand.uint64)},
+		count: &counters{},
+	}
+}
+
+// Reply is Model.Reply.
+func (f *FrozenModel) Reply(text string) string {
+	return f.m.Reply(text)
+}
+
+// ReplyErr is Model.ReplyErr.
+func (f *FrozenModel) ReplyErr(text string) (string, error) {
+	return f.m.ReplyErr(text)
+}
+
+// ReplyContext is Model.ReplyContext.
+func (f *FrozenModel) ReplyContext(ctx context.Context, text string) (string, error) {
+	return f.m.ReplyContext(ctx, text)
+}
+
+// ReplyWith is Model.ReplyWith.
+func (f *FrozenModel) ReplyWith(ctx context.Context, text string, opts ReplyOptions) (string, error) {
+	return f.m.ReplyWith(ctx, text, opts)
+}
+
+// ReplyCandidate is Model.ReplyCandidate.
+func (f *FrozenModel) ReplyCandidate(ctx context.Context, text string, opts ReplyOptions) (*Candidate, error) {
+	return f.m.ReplyCandidate(ctx, text, opts)
+}
+
+// ReplyStream is Model.ReplyStream. Since a FrozenModel isn't locked,
+// fn may take as long as it likes.
+func (f *FrozenModel) ReplyStream(ctx context.Context, text string, fn func(word string) error) (string, error) {
+	return f.m.ReplyStream(ctx, text, fn)
+}
+
+// Stats is Model.Stats. Learned and Forgot are always zero.
+func (f *FrozenModel) Stats() Stats {
+	return f.m.Stats()
+}
+
+// frozenChains holds a frozen model's chains. The contexts of each
+// length are sorted, and the tokens following and preceding context i
+// are sets 2i and 2i+1 of its chains.
+type frozenChains struct {
+	// next holds the tokens following each token, by token, and
+	// tokens is the number of those that aren't empty.
+	next   sets
+	tokens int
+
+	tri       []bigram
+	triChains sets
+
+	// hi[0] has contexts of length 3, hi[1] of length 4, etc.
+	hi []frozenLevel
+}
+
+type frozenLevel struct {
+	ctxs   []ngram
+	chains sets
+}
+
+func (f *frozenChains) nextSet(tok token) tokset {
+	if int(tok) >= f.next.len() {
+		return tokset{}
+	}
+
+	return f.next.get(int(tok))
+}
+
+func (f *frozenChains) context(k int, ctx ngram, rev bool) (tokset, bool) {
+	var i int
+	var chains *sets
+
+	if k == 2 {
+		b := bigram{ctx[0], ctx[1]}
+		i = sort.Search(len(f.tri), func(i int) bool { return !f.tri[i].less(b) })
+		if i == len(f.tri) || f.tri[i] != b {
+			return tokset{}, false
+		}
+		chains = &f.triChains
+	} else {
+		level := &f.hi[k-3]
+		i = sort.Search(len(level.ctxs), func(i int) bool { return !level.ctxs[i].less(ctx) })
+		if i == len(level.ctxs) || level.ctxs[i] != ctx {
+			return tokset{}, false
+		}
+		chains = &level.chains
+	}
+
+	if rev {
+		return chains.get(2*i + 1), true
+	}
+
+	return chains.get(2 * i), true
+}
+
+func (f *frozenChains) empty() bool {
+	return f.tokens == 0
+}
+
+// Frozen models never change, so they're read without locking.
+func (f *frozenChains) rlock()   {}
+func (f *frozenChains) runlock() {}
+
+// size returns the memory used by f.
+func (f *frozenChains) size() int64 {
+	mem := f.next.size() + 8*int64(cap(f.tri)) + f.triChains.size()
+	for _, level := range f.hi {
+		mem += ngramSize*int64(cap(level.ctxs)) + level.chains.size()
+	}
+
+	return mem
+}
+
+// sets is a list of toksets packed end to end: set i's tokens and
+// counts are buf[off[i]:off[i+1]], laid out as in a tokset, and the
+// rest of its header is meta[i]. Nothing in it is a pointer.
+type sets struct {
+	buf  []byte
+	off  []uint64
+	meta []setMeta
+
+	// checked holds two bits per set of a mapped file, recording
+	// whether get has checked it and found it valid, with tokens
+	// below ntok. It's nil for sets built in memory.
+	checked []uint32
+	ntok    int
+}
+
+type setMeta struct {
+	c3      uint32
+	c2      uint16
+	c1      uint8
+	counted bool
+}
+
+// add appends a copy of t, which may be nil, to s.
+func (s *sets) add(t *tokset) {
+	if s.off == nil {
+		s.off = []uint64{0}
+	}
+
+	var meta setMeta
+	if t != nil {
+		s.buf = append(s.buf, t.buf...)
+		meta = setMeta{c3: t.c3, c2: t.c2, c1: t.c1, counted: t.counted}
+	}
+
+	s.off = append(s.off, uint64(len(s.buf)))
+	s.meta = append(s.meta, meta)
+}
+
+// trim drops the spare capacity left by add.
+func (s *sets) trim() {
+	s.buf = append([]byte(nil), s.buf...)
+	s.off = append([]uint64(nil), s.off...)
+	s.meta = append([]setMeta(nil), s.meta...)
+}
+
+func (s *sets) len() int {
+	return len(s.meta)
+}
+
+// get returns set i. It shares s's memory, so it mustn't be changed.
+// A set from a mapped file that isn't valid is empty.
+func (s *sets) get(i int) tokset {
+	lo, hi := s.off[i], s.off[i+1]
+	meta := s.meta[i]
+
+	set := tokset{
+		buf:     s.buf[lo:hi:hi],
+		c3:      meta.c3,
+		c2:      meta.c2,
+		c1:      meta.c1,
+		counted: meta.counted,
+	}
+
+	if s.checked != nil && !s.check(i, &set) {
+		return tokset{}
+	}
+
+	return set
+}
+
+func (s *sets) size() int64 {
+	return int64(cap(s.buf)) + 8*int64(cap(s.off)) + setMetaSize*int64(cap(s.meta)) + 4*int64(cap(s.checked))
+}
+
+const setMetaSize = 8
@@ -0,0 +1,91 @@
+package fate
+
+import (
+	"context"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestFreeze(t *testing.T) {
+	rand.Seed(0)
+	sentences := corpus(vocab(200), 2000, func() int {
+		return clamp(gauss(8, 4))
+	})
+
+	configs := []Config{
+		{},
+		{Weighted: true},
+		{Order: 4},
+		{Order: 5, Weighted: true, Backoff: 2},
+	}
+
+	for _, cfg := range configs {
+		model := NewModel(cfg)
+		for _, sen := range sentences {
+			model.Learn(sen)
+		}
+
+		frozen := model.Freeze()
+
+		want, got := model.Stats(), frozen.Stats()
+		if got.Tokens != want.Tokens || got.Bigrams != want.Bigrams ||
+			got.Trigrams != want.Trigrams || got.Contexts != want.Contexts {
+			t.Errorf("%+v: Freeze().Stats() => %+v, want %+v", cfg, got, want)
+		}
+
+		if 4*got.MemoryBytes > 3*want.MemoryBytes {
+			t.Errorf("%+v: frozen model uses %d bytes, model %d", cfg, got.MemoryBytes, want.MemoryBytes)
+		}
+
+		opts := []ReplyOptions{
+			{},
+			{MaxWords: 6},
+			{Candidates: 3},
+		}
+
+		for i := 0; i < 100; i++ {
+			q := sentences[i]
+			for _, o := range opts {
+				o.Rand = rand.NewSource(int64(i))
+				want, err := model.ReplyCandidate(context.Background(), q, o)
+				if err != nil && err != ErrNoFit {
+					t.Fatal(err)
+				}
+
+				o.Rand = rand.NewSource(int64(i))
+				got, err2 := frozen.ReplyCandidate(context.Background(), q, o)
+				if err2 != err || !reflect.DeepEqual(got, want) {
+					t.Fatalf("%+v: frozen ReplyCandidate(%q, %+v) => %+v, %v; want %+v, %v",
+						cfg, q, o, got, err2, want, err)
+				}
+			}
+		}
+
+		// Without a seed, both start from the same random state.
+		if got, want := frozen.Reply("foo"), model.Reply("foo"); got != want {
+			t.Errorf("%+v: frozen Reply() => %q, want %q", cfg, got, want)
+		}
+	}
+}
+
+func TestFreezeUnchanged(t *testing.T) {
+	model := NewModel(Config{})
+	model.Learn("this is a test")
+
+	frozen := model.Freeze()
+
+	model.Learn("that was another thing")
+	model.Forget("this is a test")
+
+	for i := 0; i < 20; i++ {
+		if reply := frozen.Reply("that"); reply != "this is a test" {
+			t.Fatalf("frozen Reply() after learning => %q, want %q", reply, "this is a test")
+		}
+	}
+
+	empty := NewModel(Config{}).Freeze()
+	if reply, err := empty.ReplyErr("foo"); reply != "" || err != nil {
+		t.Errorf("ReplyErr() on an empty frozen model => %q, %v", reply, err)
+	}
+}
@@ -0,0 +1,373 @@
+package fate
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Journal is an append-only log of the text a Model learns and
+// forgets. Snapshots written by WriteTo lose anything learned since;
+// pairing one with a Journal loses nothing that reached the operating
+// system before a crash.
+//
+// Open the journal, read the model's last snapshot with the journal
+// in its Config, then Replay the journal into it. Compact folds the
+// journal into a new snapshot when it grows.
+//
+// Records are numbered in order, and the numbering carries on across
+// compactions: the journal's header holds the number of its first
+// record, and snapshots hold the number of the first record they
+// don't include, so Replay skips the records a snapshot already has.
+// Each record is its length, a kind byte and the text, followed by a
+// CRC32 of the kind and text.
+type Journal struct {
+	lock sync.Mutex
+	path string
+	f    *os.File
+	err  error
+
+	// seq is the number of the next record.
+	seq uint64
+}
+
+var journalMagic = [4]byte{'f', 'a', 't', 'j'}
+
+const (
+	// The header is the magic, the version and the number of the
+	// first record.
+	journalVersion = 1
+	journalHeader  = 16
+
+	// maxRecord bounds the text in a single record.
+	maxRecord = 1 << 24
+)
+
+type recordKind byte
+
+const (
+	recordLearn  recordKind = 'L'
+	recordForget recordKind = 'F'
+)
+
+// ErrJournalRecord is returned when text is too long to journal.
+var ErrJournalRecord = errors.New("fate: text too long for the journal")
+
+// OpenJournal opens the journal at path, creating it if necessary. A
+// record cut short by a crash, and anything after it, is truncated
+// away so new records can be appended.
+func OpenJournal(path string) (*Journal, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	j := &Journal{path: path, f: f}
+	if err := j.open(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return j, nil
+}
+
+// open checks the journal's header, writing one to an empty journal,
+// and positions it after the last good record.
+func (j *Journal) open() error {
+	info, err := j.f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if info.Size() == 0 {
+		_, err := j.f.Write(journalHead(0))
+		return err
+	}
+
+	seq, end, err := scan(j.f, nil)
+	if err != nil {
+		return err
+	}
+
+	j.seq = seq
+	return j.truncate(end)
+}
+
+// journalHead returns the header of a journal whose first record is
+// number base.
+func journalHead(base uint64) []byte {
+	head := make([]byte, journalHeader)
+	copy(head, journalMagic[:])
+	binary.LittleEndian.PutUint32(head[4:], journalVersion)
+	binary.LittleEndian.PutUint64(head[8:], base)
+	return head
+}
+
+// Replay learns and forgets everything in the journal into m, without
+// journaling it again, and returns the number of records replayed.
+// Records the snapshot m was read from already has are skipped. Call
+// it before using m, since anything m journals before Replay reaches
+// it is replayed too.
+func (j *Journal) Replay(m *Model) (int, error) {
+	f, err := os.Open(j.path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var n int
+	_, _, err = scan(f, func(seq uint64, kind recordKind, text string) {
+		if seq < m.journaled {
+			return
+		}
+
+		n++
+		if kind == recordLearn {
+			m.learn(text, false)
+		} else {
+			m.forget(text, false)
+		}
+	})
+	if err != nil {
+		return n, err
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	// The snapshot has every record, and maybe some this journal
+	// never saw. Start it over after them, so its next record isn't
+	// numbered as one the snapshot has.
+	if j.seq < m.journaled {
+		return n, j.restart(m.journaled)
+	}
+
+	return n, nil
+}
+
+// scan reads a journal from its beginning, calling fn with each
+// record and its number. It returns the number of the record after
+// the last good one, and the offset where that record would start.
+func scan(f io.Reader, fn func(seq uint64, kind recordKind, text string)) (uint64, int64, error) {
+	r := bufio.NewReader(f)
+
+	var head [journalHeader]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil ||
+		[4]byte{head[0], head[1], head[2], head[3]} != journalMagic ||
+		binary.LittleEndian.Uint32(head[4:]) != journalVersion {
+		return 0, 0, ErrFormat
+	}
+
+	seq := binary.LittleEndian.Uint64(head[8:])
+	end := int64(journalHeader)
+
+	for {
+		kind, text, size, ok := readRecord(r)
+		if !ok {
+			return seq, end, nil
+		}
+
+		if fn != nil {
+			fn(seq, kind, text)
+		}
+		seq++
+		end += size
+	}
+}
+
+// readRecord reads one record from r. It reports false at the end of
+// the journal, or at a record that's incomplete or corrupt.
+func readRecord(r io.Reader) (kind recordKind, text string, size int64, ok bool) {
+	var buf [4]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return 0, "", 0, false
+	}
+
+	n := binary.LittleEndian.Uint32(buf[:])
+	if n == 0 || n > maxRecord+1 {
+		return 0, "", 0, false
+	}
+
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, "", 0, false
+	}
+
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return 0, "", 0, false
+	}
+
+	if binary.LittleEndian.Uint32(buf[:]) != crc32.ChecksumIEEE(payload) {
+		return 0, "", 0, false
+	}
+
+	kind = recordKind(payload[0])
+	if kind != recordLearn && kind != recordForget {
+		return 0, "", 0, false
+	}
+
+	return kind, string(payload[1:]), int64(8 + n), true
+}
+
+// append writes a record to the journal. Errors are kept for Err.
+func (j *Journal) append(kind recordKind, text string) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.err != nil {
+		return
+	}
+
+	if len(text) > maxRecord {
+		j.err = ErrJournalRecord
+		return
+	}
+
+	buf := make([]byte, 4+1+len(text)+4)
+	binary.LittleEndian.PutUint32(buf, uint32(1+len(text)))
+	buf[4] = byte(kind)
+	copy(buf[5:], text)
+	binary.LittleEndian.PutUint32(buf[5+len(text):], crc32.ChecksumIEEE(buf[4:5+len(text)]))
+
+	// One write per record, so a crash can only tear the last one.
+	if _, j.err = j.f.Write(buf); j.err == nil {
+		j.seq++
+	}
+}
+
+// next returns the number of the next record.
+func (j *Journal) next() uint64 {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	return j.seq
+}
+
+// Err returns the first error the journal hit while appending. Once
+// there's been an error, nothing more is journaled.
+func (j *Journal) Err() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	return j.err
+}
+
+// Sync commits the journal to stable storage.
+func (j *Journal) Sync() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.err != nil {
+		return j.err
+	}
+
+	return j.f.Sync()
+}
+
+// Compact writes a snapshot of m, the model the journal belongs to,
+// to path and empties the journal. The snapshot is written to a
+// temporary file and renamed into place, and learning waits until
+// it's done.
+//
+// The snapshot records how much of the journal it has, so a crash
+// before the journal is emptied only leaves records Replay skips.
+func (j *Journal) Compact(m *Model, path string) error {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.err != nil {
+		return j.err
+	}
+
+	if err := writeFile(m, path, j.seq); err != nil {
+		return err
+	}
+
+	return j.restart(j.seq)
+}
+
+// restart replaces the journal with an empty one whose first record
+// is number base. The new journal is written beside the old one and
+// renamed over it, so a crash leaves one or the other.
+func (j *Journal) restart(base uint64) error {
+	f, err := ioutil.TempFile(filepath.Dir(j.path), filepath.Base(j.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+
+	tmp := f.Name()
+
+	_, err = f.Write(journalHead(base))
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, j.path)
+	}
+
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	j.f.Close()
+	j.f, j.seq = f, base
+	return nil
+}
+
+// truncate cuts the journal off at end and positions it for appends.
+func (j *Journal) truncate(end int64) error {
+	if err := j.f.Truncate(end); err != nil {
+		return err
+	}
+
+	_, err := j.f.Seek(end, io.SeekStart)
+	return err
+}
+
+// Close closes the journal.
+func (j *Journal) Close() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	return j.f.Close()
+}
+
+// writeFile writes a snapshot of m to path through a temporary file in
+// the same directory, so path always holds a complete snapshot. seq is
+// as for writeTo, and the caller must hold m's lock.
+func writeFile(m *Model, path string, seq uint64) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+
+	tmp := f.Name()
+
+	_, err = m.writeTo(f, seq)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+	}
+
+	return err
+}
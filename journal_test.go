@@ -0,0 +1,263 @@
+package fate
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "fate")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestJournalReplay(t *testing.T) {
+	path := filepath.Join(tempDir(t), "journal")
+
+	j, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	model := NewModel(Config{Weighted: true, Journal: j})
+	model.Learn("this is a test")
+	model.Learn("single")
+	model.Learn("this is another test")
+	model.Learn("this is a test")
+	if err := model.Forget("this is another test"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := j.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	j, err = OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	replayed := NewModel(Config{Weighted: true, Journal: j})
+	n, err := j.Replay(replayed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 4 {
+		t.Errorf("Replay() => %d records, want 4", n)
+	}
+
+	want, got := model.Stats(), replayed.Stats()
+	if got.Tokens != want.Tokens || got.Trigrams != want.Trigrams || got.Forgot != 1 {
+		t.Errorf("Replay() => %+v, want %+v", got, want)
+	}
+
+	// Replaying doesn't journal the records again.
+	if n, err := j.Replay(NewModel(Config{Weighted: true})); n != 4 || err != nil {
+		t.Errorf("Replay() again => %d, %v, want 4 records", n, err)
+	}
+}
+
+func TestJournalTorn(t *testing.T) {
+	path := filepath.Join(tempDir(t), "journal")
+
+	j, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	model := NewModel(Config{Journal: j})
+	model.Learn("this is a test")
+	model.Learn("this is another test")
+	j.Close()
+
+	// Cut the last record short, as a crash might.
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	j, err = OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	model = NewModel(Config{Journal: j})
+	if n, err := j.Replay(model); n != 1 || err != nil {
+		t.Fatalf("Replay() => %d, %v, want 1 record", n, err)
+	}
+
+	// New records follow the last good one.
+	model.Learn("there are more tests")
+	if n, err := j.Replay(NewModel(Config{})); n != 2 || err != nil {
+		t.Errorf("Replay() => %d, %v after appending, want 2 records", n, err)
+	}
+}
+
+func TestJournalCompact(t *testing.T) {
+	dir := tempDir(t)
+	path, snapshot := filepath.Join(dir, "journal"), filepath.Join(dir, "model.fate")
+
+	j, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	model := NewModel(Config{Rand: rand.NewSource(1), Journal: j})
+	model.Learn("this is a test")
+
+	if err := j.Compact(model, snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	model.Learn("this is another test")
+
+	f, err := os.Open(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	loaded, err := ReadModel(f, Config{Rand: rand.NewSource(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the line learned after compacting is left to replay.
+	if n, err := j.Replay(loaded); n != 1 || err != nil {
+		t.Fatalf("Replay() => %d, %v, want 1 record", n, err)
+	}
+
+	if got, want := loaded.Stats().Trigrams, model.Stats().Trigrams; got != want {
+		t.Errorf("Replay() after Compact => %d trigrams, want %d", got, want)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 2 {
+		t.Errorf("Compact() left %d files, want 2", len(files))
+	}
+}
+
+func TestJournalFormat(t *testing.T) {
+	path := filepath.Join(tempDir(t), "journal")
+	if err := ioutil.WriteFile(path, []byte("not a journal"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenJournal(path); err != ErrFormat {
+		t.Errorf("OpenJournal() => %v, want %v", err, ErrFormat)
+	}
+}
+
+func TestJournalCrash(t *testing.T) {
+	dir := tempDir(t)
+	path, snapshot := filepath.Join(dir, "journal"), filepath.Join(dir, "model.fate")
+
+	j, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	model := NewModel(Config{Weighted: true, Journal: j})
+	model.Learn("this is a test")
+	model.Learn("this is another test")
+
+	// Crash after writing a snapshot, but before emptying the
+	// journal.
+	model.lock.RLock()
+	err = writeFile(model, snapshot, j.next())
+	model.lock.RUnlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	model.Learn("this is a test")
+	j.Close()
+
+	j, err = OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	loaded := readFile(t, snapshot, Config{Journal: j})
+	if n, err := j.Replay(loaded); n != 1 || err != nil {
+		t.Fatalf("Replay() => %d, %v, want 1 record", n, err)
+	}
+
+	// The weighted counts of the snapshot's lines aren't doubled.
+	got, want := chainWords(loaded), chainWords(model)
+	for ctx, w := range want {
+		if g := got[ctx]; g != w {
+			t.Errorf("Replay() => chain %q %q, want %q", ctx, g, w)
+		}
+	}
+}
+
+func TestJournalBehind(t *testing.T) {
+	dir := tempDir(t)
+	snapshot := filepath.Join(dir, "model.fate")
+
+	j, err := OpenJournal(filepath.Join(dir, "journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	model := NewModel(Config{Journal: j})
+	model.Learn("this is a test")
+	model.Learn("this is another test")
+	if err := j.Compact(model, snapshot); err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+
+	// A new journal starts over after the snapshot's records, so
+	// the lines learned into it aren't taken for those.
+	j, err = OpenJournal(filepath.Join(dir, "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	loaded := readFile(t, snapshot, Config{Journal: j})
+	if n, err := j.Replay(loaded); n != 0 || err != nil {
+		t.Fatalf("Replay() => %d, %v, want no records", n, err)
+	}
+
+	loaded.Learn("there are more tests")
+	if n, err := j.Replay(readFile(t, snapshot, Config{})); n != 1 || err != nil {
+		t.Errorf("Replay() => %d, %v after learning, want 1 record", n, err)
+	}
+}
+
+func readFile(t *testing.T, path string, opts Config) *Model {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	m, err := ReadModel(f, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return m
+}
@@ -0,0 +1,158 @@
+package fate
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// learnBatch is how many lines each of LearnAll's workers learns at a
+// time, while the model is locked.
+const learnBatch = 256
+
+// LearnAll learns every line received from lines, on workers
+// goroutines at once, until lines is closed or ctx is done. It returns
+// the number of lines learned, and ctx's error if it stopped early.
+// With workers below 1, it uses GOMAXPROCS.
+//
+// Lines are learned in batches. The model is locked for writing while
+// each batch is learned, as it is for Learn, so replies wait for the
+// batch but can go between them.
+//
+// Learning is the same as calling Learn on each line, in whatever
+// order the workers get to them. New words are numbered in that order
+// too, so a snapshot may not be byte for byte the same as one made
+// with Learn, but the two models reply alike.
+func (m *Model) LearnAll(ctx context.Context, lines <-chan string, workers int) (int, error) {
+	if workers < 1 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	s := &stripes{}
+	bufs := make([][]token, workers)
+	batch := make([]string, 0, workers*learnBatch)
+
+	n := 0
+	for {
+		var more bool
+		var err error
+		batch, more, err = readBatch(ctx, lines, batch[:0])
+
+		n += m.learnBatch(batch, workers, s, bufs)
+		if !more {
+			return n, err
+		}
+	}
+}
+
+// readBatch appends lines to batch until it's full or no more are
+// waiting. It blocks for the first line only. more is false once
+// lines is closed or ctx is done.
+func readBatch(ctx context.Context, lines <-chan string, batch []string) (ret []string, more bool, err error) {
+	select {
+	case line, ok := <-lines:
+		if !ok {
+			return batch, false, nil
+		}
+		batch = append(batch, line)
+	case <-ctx.Done():
+		return batch, false, ctx.Err()
+	}
+
+	for len(batch) < cap(batch) {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				return batch, false, nil
+			}
+			batch = append(batch, line)
+		default:
+			return batch, true, nil
+		}
+	}
+
+	return batch, true, nil
+}
+
+// learnBatch learns batch on workers goroutines, returning the number
+// of lines learned. The lines are tokenized before the model is
+// locked. bufs holds a scratch buffer for each worker.
+func (m *Model) learnBatch(batch []string, workers int, s *stripes, bufs [][]token) int {
+	words := make([][]string, len(batch))
+	parallel(len(batch), workers, func(_, i int) {
+		words[i] = m.split(batch[i])
+	})
+
+	var n int64
+
+	m.lock.Lock()
+	m.stripes = s
+
+	parallel(len(batch), workers, func(w, i int) {
+		// Refuse to learn single-word inputs.
+		if len(words[i]) < 2 {
+			return
+		}
+
+		bufs[w] = m.ids(bufs[w], words[i])
+		m.observeLine(bufs[w])
+
+		if m.journal != nil {
+			m.journal.append(recordLearn, batch[i])
+		}
+
+		stats.Add("Learned", 1)
+		atomic.AddInt64(&m.count.learned, 1)
+		atomic.AddInt64(&n, 1)
+	})
+
+	m.stripes = nil
+	m.lock.Unlock()
+
+	return int(n)
+}
+
+// ids appends the tokens of words to buf[:0], adding any new ones to
+// the dictionary. The caller must be one of LearnAll's workers.
+func (m *Model) ids(buf []token, words []string) []token {
+	buf = buf[:0]
+
+	// Most words are known already, so try without excluding the
+	// other workers first.
+	m.stripes.dict.RLock()
+	for _, word := range words {
+		tok, ok := m.tokens.CheckID(word)
+		if !ok {
+			break
+		}
+		buf = append(buf, tok)
+	}
+	m.stripes.dict.RUnlock()
+
+	if len(buf) < len(words) {
+		m.stripes.dict.Lock()
+		for _, word := range words[len(buf):] {
+			buf = append(buf, m.tokens.ID(word))
+		}
+		m.stripes.dict.Unlock()
+	}
+
+	return buf
+}
+
+// parallel calls fn(w, i) for every i below n, spread across workers
+// goroutines. w is the worker calling it.
+func parallel(n, workers int, fn func(w, i int)) {
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < n; i += workers {
+				fn(w, i)
+			}
+		}(w)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,187 @@
+package fate
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLearnAll(t *testing.T) {
+	rand.Seed(0)
+	sentences := corpus(vocab(200), 1000, func() int {
+		return clamp(gauss(8, 4))
+	})
+	sentences = append(sentences, "", "one", "  two  words ")
+
+	configs := []Config{
+		{},
+		{Weighted: true},
+		{Order: 5, Weighted: true},
+		{Tokenizer: PunctTokenizer},
+	}
+
+	for _, cfg := range configs {
+		want := NewModel(cfg)
+		learnable := 0
+		for _, sen := range sentences {
+			if want.Learnable(sen) {
+				learnable++
+			}
+			want.Learn(sen)
+		}
+
+		got := NewModel(cfg)
+		n, err := got.LearnAll(context.Background(), lines(sentences), 4)
+		if err != nil || n != learnable {
+			t.Fatalf("%+v: LearnAll() => %d, %v; want %d", cfg, n, err, learnable)
+		}
+
+		ws, gs := want.Stats(), got.Stats()
+		if gs.Tokens != ws.Tokens || gs.Bigrams != ws.Bigrams || gs.Trigrams != ws.Trigrams ||
+			gs.Contexts != ws.Contexts || gs.Learned != ws.Learned {
+			t.Errorf("%+v: LearnAll Stats() => %+v, want %+v", cfg, gs, ws)
+		}
+
+		wc, gc := chainWords(want), chainWords(got)
+		for ctx, w := range wc {
+			if g := gc[ctx]; g != w {
+				t.Fatalf("%+v: LearnAll chain %q => %q, want %q", cfg, ctx, g, w)
+			}
+		}
+		if len(gc) != len(wc) {
+			t.Errorf("%+v: LearnAll learned %d chains, want %d", cfg, len(gc), len(wc))
+		}
+	}
+}
+
+func TestLearnAllReplies(t *testing.T) {
+	rand.Seed(0)
+	words := vocab(200)
+	sentences := corpus(words, 5000, func() int {
+		return 2 + rand.Intn(10)
+	})
+
+	known := make(map[string]bool)
+	for _, word := range words {
+		known[word] = true
+	}
+
+	model := NewModel(Config{Order: 4, Weighted: true})
+
+	replying, stop := context.WithCancel(context.Background())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-replying.Done():
+					return
+				default:
+				}
+
+				reply, err := model.ReplyErr(strchoice(words))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				for _, word := range strings.Fields(reply) {
+					if !known[word] {
+						t.Errorf("Reply() => %q, with unknown word %q", reply, word)
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	n, err := model.LearnAll(context.Background(), lines(sentences), 4)
+	stop()
+	wg.Wait()
+
+	if err != nil || n != len(sentences) {
+		t.Fatalf("LearnAll() => %d, %v; want %d", n, err, len(sentences))
+	}
+}
+
+func TestLearnAllCanceled(t *testing.T) {
+	model := NewModel(Config{})
+
+	ch := make(chan string, 1)
+	ch <- "this is a test"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for model.Stats().Learned == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+	}()
+
+	n, err := model.LearnAll(ctx, ch, 2)
+	if n != 1 || err != context.Canceled {
+		t.Fatalf("LearnAll() => %d, %v; want 1, %v", n, err, context.Canceled)
+	}
+}
+
+// lines returns a closed channel holding strs.
+func lines(strs []string) <-chan string {
+	ch := make(chan string, len(strs))
+	for _, s := range strs {
+		ch <- s
+	}
+
+	// The builtin close is hidden by quotefix.go's.
+	reflect.ValueOf(ch).Close()
+	return ch
+}
+
+// chainWords describes everything m has learned in words, so models
+// whose tokens are numbered differently can be compared.
+func chainWords(m *Model) map[string]string {
+	ret := make(map[string]string)
+
+	m.bi.each(func(tok token, next *tokset) {
+		ret[m.tokens.Word(tok)] = setWords(m, next)
+	})
+
+	m.tri.each(func(ctx bigram, chain *fwdrev) {
+		key := ctxWords(m, ctx.tok0, ctx.tok1)
+		ret[key] = setWords(m, &chain.fwd) + " | " + setWords(m, &chain.rev)
+	})
+
+	for i := range m.hi {
+		m.hi[i].each(func(ctx ngram, chain *fwdrev) {
+			key := ctxWords(m, ctx[:i+3]...)
+			ret[key] = setWords(m, &chain.fwd) + " | " + setWords(m, &chain.rev)
+		})
+	}
+
+	return ret
+}
+
+func ctxWords(m *Model, toks ...token) string {
+	words := make([]string, len(toks))
+	for i, tok := range toks {
+		words[i] = m.tokens.Word(tok)
+	}
+	return strings.Join(words, " ")
+}
+
+func setWords(m *Model, t *tokset) string {
+	var words []string
+	for _, tok := range t.Tokens() {
+		words = append(words, fmt.Sprintf("%s:%d", m.tokens.Word(tok), t.CountOf(tok)))
+	}
+	sort.Strings(words)
+	return strings.Join(words, " ")
+}
@@ -0,0 +1,747 @@
+package fate
+
+import (
+	"encoding/binary"
+	"io"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Frozen model files are laid out so OpenFrozen can use them in place,
+// without decoding: every array a FrozenModel reads is stored as it's
+// kept in memory, little-endian and 8-byte aligned.
+//
+// The file starts with a magic string and a format version, the model
+// flags and order, the start and end tokens and the number of tokens
+// with successors. A table of sections follows, each an offset and a
+// length in bytes, then the sections themselves:
+//
+//	word offsets, word bytes, word hash slots,
+//	stem offsets, stem bytes, synonym offsets, synonym tokens,
+//	stem hash slots,
+//	successor set offsets, headers and bytes, for each token,
+//	bigram contexts, then their set offsets, headers and bytes,
+//
+// then the contexts and sets for each longer context length. A set's
+// bytes are laid out as in a tokset. Like a snapshot, the file ends
+// with a CRC-32 of everything before it, which OpenFrozen doesn't check
+// so that startup needn't read the whole file.
+var mappedMagic = [4]byte{'f', 'a', 't', 'm'}
+
+const (
+	mappedVersion = 1
+	mappedHeader  = 32
+
+	// The dictionary takes eight sections, and each list of sets
+	// three: offsets, headers and bytes.
+	mappedDictSections = 8
+	mappedSetsSections = 3
+)
+
+// setMeta is stored as it's laid out in memory.
+var _ [unsafe.Sizeof(setMeta{}) - setMetaSize]struct{}
+var _ [setMetaSize - unsafe.Sizeof(setMeta{})]struct{}
+
+// littleEndian reports whether this machine can use the file's arrays
+// in place.
+var littleEndian = func() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}()
+
+// OpenFrozen opens a FrozenModel written by FrozenModel.WriteTo. The
+// file is mapped into memory rather than read, so large models open
+// immediately and processes serving the same file share its pages.
+// Close the model to unmap it.
+//
+// OpenFrozen checks the file's headers, offsets and lengths, so a
+// damaged file is an error rather than a panic, without reading the
+// rest of it or its checksum. The tokens and counts in each set are
+// checked the first time the set is read, and a damaged set reads as
+// empty.
+//
+// As with ReadModel, the Stemmer and Rand in opts aren't part of the
+// file, and Weighted and Order are taken from it.
+func OpenFrozen(path string, opts Config) (*FrozenModel, error) {
+	if !littleEndian {
+		return nil, ErrFormat
+	}
+
+	data, unmap, err := mapFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := mapModel(data, opts)
+	if err != nil {
+		unmap()
+		return nil, err
+	}
+
+	return &FrozenModel{m: m, close: unmap}, nil
+}
+
+// Close releases the memory of a model opened by OpenFrozen. Neither
+// the model nor anything borrowed from it may be used afterward.
+func (f *FrozenModel) Close() error {
+	if f.close == nil {
+		return nil
+	}
+
+	err := f.close()
+	f.close = nil
+	return err
+}
+
+// mapModel makes a frozen model of the file in data, which it uses in
+// place. It checks that everything the model will index is in bounds.
+func mapModel(data []byte, opts Config) (*Model, error) {
+	if len(data) < mappedHeader ||
+		[4]byte{data[0], data[1], data[2], data[3]} != mappedMagic ||
+		binary.LittleEndian.Uint32(data[4:]) != mappedVersion {
+		return nil, ErrFormat
+	}
+
+	flags := binary.LittleEndian.Uint32(data[8:])
+	order := int(binary.LittleEndian.Uint32(data[12:]))
+	if order < 3 || order > MaxOrder {
+		return nil, ErrFormat
+	}
+
+	// Each context length has its contexts and their sets.
+	r := &sectionReader{data: data}
+	r.count = mappedDictSections + mappedSetsSections + (order-2)*(1+mappedSetsSections)
+
+	t := &wordTable{
+		off:       r.uint64s(),
+		bytes:     r.bytes(),
+		slots:     r.uint32s(),
+		stemOff:   r.uint64s(),
+		stemBytes: r.bytes(),
+		synOff:    r.uint64s(),
+		synToks:   r.tokens(),
+		stemSlots: r.uint32s(),
+	}
+
+	f := &frozenChains{tokens: int(binary.LittleEndian.Uint64(data[24:]))}
+	f.next = r.sets()
+	f.tri = r.bigrams()
+	f.triChains = r.sets()
+
+	f.hi = make([]frozenLevel, order-3)
+	for i := range f.hi {
+		f.hi[i].ctxs = r.ngrams()
+		f.hi[i].chains = r.sets()
+	}
+
+	if r.err != nil || !t.valid() || !f.valid(t.len()) {
+		return nil, ErrChecksum
+	}
+	f.checkLazily(t.len())
+
+	start := token(binary.LittleEndian.Uint32(data[16:]))
+	end := token(binary.LittleEndian.Uint32(data[20:]))
+	if int(start) >= t.len() || int(end) >= t.len() {
+		return nil, ErrChecksum
+	}
+
+	opts.Weighted = flags&flagWeighted != 0
+	opts.Order = order
+
+	return &Model{
+		tokens:   &syndict{stemmer: opts.stemmerOrDefault(), table: t},
+		startTok: start,
+		endTok:   end,
+
+		hi:      make([]ngrams, order-3),
+		order:   order,
+		backoff: opts.backoffOrDefault(),
+
+		weighted: opts.Weighted,
+		maxPath:  opts.maxPathOrDefault(),
+
+		tokenizer:   opts.tokenizerOrDefault(),
+		detokenizer: opts.detokenizerOrDefault(),
+
+		chains: f,
+
+		rand:  &prng{uint64(opts.randOrDefault().Int63())},
+		count: &counters{},
+	}, nil
+}
+
+// valid reports whether f has a set for each of n tokens and two for
+// each context, and whether the sets' headers fit them. Contexts are
+// only compared, so their tokens needn't be checked.
+func (f *frozenChains) valid(n int) bool {
+	if !f.next.valid() || f.next.len() != n || f.tokens > n {
+		return false
+	}
+
+	if !f.triChains.valid() || f.triChains.len() != 2*len(f.tri) {
+		return false
+	}
+
+	for _, level := range f.hi {
+		if !level.chains.valid() || level.chains.len() != 2*len(level.ctxs) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// checkLazily has f's sets check their tokens, which must be below n,
+// and counts as they're read.
+func (f *frozenChains) checkLazily(n int) {
+	f.next.checkLazily(n)
+	f.triChains.checkLazily(n)
+	for i := range f.hi {
+		f.hi[i].chains.checkLazily(n)
+	}
+}
+
+// valid reports whether every set in s is within its bytes and has a
+// header that fits them.
+func (s *sets) valid() bool {
+	if len(s.off) != len(s.meta)+1 || !increasing(s.off, uint64(len(s.buf))) {
+		return false
+	}
+
+	// The bool in each header must be a bool.
+	raw := s.metaBytes()
+
+	for i, meta := range s.meta {
+		lo, hi := s.off[i], s.off[i+1]
+		if raw[setMetaSize*i+7] > 1 {
+			return false
+		}
+
+		if !toksetFits(int(hi-lo), int(meta.c1), int(meta.c2), int(meta.c3), meta.counted) {
+			return false
+		}
+	}
+
+	return true
+}
+
+const (
+	setInvalid = 1
+	setValid   = 2
+)
+
+func (s *sets) checkLazily(n int) {
+	s.checked = make([]uint32, (s.len()+15)/16)
+	s.ntok = n
+}
+
+// check reports whether set, which is set i, is valid, checking it
+// the first time it's read.
+func (s *sets) check(i int, set *tokset) bool {
+	word, shift := &s.checked[i/16], uint(i%16)*2
+
+	if state := atomic.LoadUint32(word) >> shift & 3; state != 0 {
+		return state == setValid
+	}
+
+	state := uint32(setInvalid)
+	if set.valid(s.ntok) {
+		state = setValid
+	}
+
+	for {
+		old := atomic.LoadUint32(word)
+		if atomic.CompareAndSwapUint32(word, old, old|state<<shift) {
+			return state == setValid
+		}
+	}
+}
+
+// valid reports whether t's tokens are increasing and below n, and, if
+// t is counted, whether its cumulative counts are increasing too: every
+// token was added at least once.
+func (t *tokset) valid(n int) bool {
+	counts := t.counts()
+
+	prev, total := -1, uint32(0)
+	for i := 0; i < t.Len(); i++ {
+		tok := int(t.Index(i))
+		if tok <= prev || tok >= n {
+			return false
+		}
+		prev = tok
+
+		if t.counted {
+			c := unpackcount(counts[4*i:])
+			if c <= total {
+				return false
+			}
+			total = c
+		}
+	}
+
+	return true
+}
+
+func (s *sets) metaBytes() []byte {
+	var raw []byte
+	if len(s.meta) > 0 {
+		setSlice(unsafe.Pointer(&raw), unsafe.Pointer(&s.meta[0]), setMetaSize*len(s.meta))
+	}
+
+	return raw
+}
+
+// toksetFits reports whether size bytes hold a tokset with c1, c2 and
+// c3 tokens of 1, 2 and 3 bytes: whatever follows them and their
+// counts must be whole 4-byte tokens, each with a count if the set
+// has them.
+func toksetFits(size, c1, c2, c3 int, counted bool) bool {
+	rest, width := size-c1-2*c2-3*c3, 4
+	if counted {
+		rest -= 4 * (c1 + c2 + c3)
+		width = 8
+	}
+
+	return rest >= 0 && rest%width == 0
+}
+
+// sectionReader reads the section table of a frozen model file,
+// returning each section in turn as an array that uses the file's
+// memory.
+type sectionReader struct {
+	data  []byte
+	count int
+	i     int
+	err   error
+}
+
+// section returns the next section's bytes, which must be a whole
+// number of elements of size bytes.
+func (r *sectionReader) section(size int) []byte {
+	if r.err != nil {
+		return nil
+	}
+
+	entry := mappedHeader + 16*r.i
+	if r.i >= r.count || entry+16 > len(r.data) {
+		r.err = ErrChecksum
+		return nil
+	}
+	r.i++
+
+	off := binary.LittleEndian.Uint64(r.data[entry:])
+	n := binary.LittleEndian.Uint64(r.data[entry+8:])
+	if off%8 != 0 || off > uint64(len(r.data)) || n > uint64(len(r.data))-off || n%uint64(size) != 0 {
+		r.err = ErrChecksum
+		return nil
+	}
+
+	return r.data[off : off+n : off+n]
+}
+
+func (r *sectionReader) bytes() []byte {
+	return r.section(1)
+}
+
+func (r *sectionReader) uint64s() []uint64 {
+	var s []uint64
+	r.cast(unsafe.Pointer(&s), 8)
+	return s
+}
+
+func (r *sectionReader) uint32s() []uint32 {
+	var s []uint32
+	r.cast(unsafe.Pointer(&s), 4)
+	return s
+}
+
+func (r *sectionReader) tokens() []token {
+	var s []token
+	r.cast(unsafe.Pointer(&s), 4)
+	return s
+}
+
+func (r *sectionReader) bigrams() []bigram {
+	var s []bigram
+	r.cast(unsafe.Pointer(&s), int(unsafe.Sizeof(bigram{})))
+	return s
+}
+
+func (r *sectionReader) ngrams() []ngram {
+	var s []ngram
+	r.cast(unsafe.Pointer(&s), int(unsafe.Sizeof(ngram{})))
+	return s
+}
+
+func (r *sectionReader) sets() sets {
+	var s sets
+	r.cast(unsafe.Pointer(&s.off), 8)
+	r.cast(unsafe.Pointer(&s.meta), setMetaSize)
+	s.buf = r.bytes()
+	return s
+}
+
+// cast points the slice at dst, whose elements are size bytes, at the
+// next section.
+func (r *sectionReader) cast(dst unsafe.Pointer, size int) {
+	buf := r.section(size)
+	if len(buf) > 0 {
+		setSlice(dst, unsafe.Pointer(&buf[0]), len(buf)/size)
+	}
+}
+
+// setSlice points the slice at dst at n elements starting at p.
+func setSlice(dst, p unsafe.Pointer, n int) {
+	h := (*reflect.SliceHeader)(dst)
+	h.Data = uintptr(p)
+	h.Len = n
+	h.Cap = n
+}
+
+// WriteTo writes f to w in the layout OpenFrozen maps. It implements
+// io.WriterTo.
+func (f *FrozenModel) WriteTo(w io.Writer) (int64, error) {
+	m := f.m
+
+	t := m.tokens.table
+	if t == nil {
+		t = newWordTable(m.tokens)
+	}
+
+	secs := []section{
+		uint64Section(t.off),
+		bytesSection(t.bytes),
+		uint32Section(t.slots),
+		uint64Section(t.stemOff),
+		bytesSection(t.stemBytes),
+		uint64Section(t.synOff),
+		tokenSection(t.synToks),
+		uint32Section(t.stemSlots),
+	}
+
+	fc := m.chains.(*frozenChains)
+	secs = append(secs, setsSections(&fc.next)...)
+	secs = append(secs, bigramSection(fc.tri))
+	secs = append(secs, setsSections(&fc.triChains)...)
+	for i := range fc.hi {
+		secs = append(secs, ngramSection(fc.hi[i].ctxs))
+		secs = append(secs, setsSections(&fc.hi[i].chains)...)
+	}
+
+	e := newEncoder(w)
+
+	e.write(mappedMagic[:])
+	e.uint32(mappedVersion)
+
+	var flags uint32
+	if m.weighted {
+		flags |= flagWeighted
+	}
+	e.uint32(flags)
+	e.uint32(uint32(m.order))
+	e.uint32(uint32(m.startTok))
+	e.uint32(uint32(m.endTok))
+	e.uint64(uint64(fc.tokens))
+
+	off := int64(mappedHeader + 16*len(secs))
+	for _, sec := range secs {
+		e.uint64(uint64(off))
+		e.uint64(uint64(sec.size))
+		off = align8(off + sec.size)
+	}
+
+	var pad [8]byte
+	for _, sec := range secs {
+		sec.write(e)
+		e.write(pad[:align8(sec.size)-sec.size])
+	}
+
+	return e.finish()
+}
+
+func align8(n int64) int64 {
+	return (n + 7) &^ 7
+}
+
+// section is a section of a frozen model file, and how to write it.
+type section struct {
+	size  int64
+	write func(e *encoder)
+}
+
+func bytesSection(buf []byte) section {
+	return section{int64(len(buf)), func(e *encoder) { e.write(buf) }}
+}
+
+func uint64Section(v []uint64) section {
+	return section{8 * int64(len(v)), func(e *encoder) {
+		for _, x := range v {
+			e.uint64(x)
+		}
+	}}
+}
+
+func uint32Section(v []uint32) section {
+	return section{4 * int64(len(v)), func(e *encoder) {
+		for _, x := range v {
+			e.uint32(x)
+		}
+	}}
+}
+
+func tokenSection(v []token) section {
+	return section{4 * int64(len(v)), func(e *encoder) {
+		for _, tok := range v {
+			e.uint32(uint32(tok))
+		}
+	}}
+}
+
+func bigramSection(v []bigram) section {
+	return section{8 * int64(len(v)), func(e *encoder) {
+		for _, b := range v {
+			e.uint32(uint32(b.tok0))
+			e.uint32(uint32(b.tok1))
+		}
+	}}
+}
+
+func ngramSection(v []ngram) section {
+	return section{ngramSize * int64(len(v)), func(e *encoder) {
+		for _, ctx := range v {
+			for _, tok := range ctx {
+				e.uint32(uint32(tok))
+			}
+		}
+	}}
+}
+
+// setsSections returns the sections holding s: its offsets, headers
+// and bytes.
+func setsSections(s *sets) []section {
+	off := s.off
+	if len(off) == 0 {
+		off = []uint64{0}
+	}
+
+	meta := section{setMetaSize * int64(len(s.meta)), func(e *encoder) {
+		var buf [setMetaSize]byte
+		for _, m := range s.meta {
+			binary.LittleEndian.PutUint32(buf[0:], m.c3)
+			binary.LittleEndian.PutUint16(buf[4:], m.c2)
+			buf[6] = m.c1
+			buf[7] = 0
+			if m.counted {
+				buf[7] = 1
+			}
+			e.write(buf[:])
+		}
+	}}
+
+	return []section{uint64Section(off), meta, bytesSection(s.buf)}
+}
+
+// wordTable is a frozen model's dictionary, arranged to be used in
+// place in a file. Words and stems are found with open addressing
+// hash tables, whose slots hold a word's token or a stem's index, plus
+// one; zero slots are empty.
+type wordTable struct {
+	// Word i is bytes[off[i]:off[i+1]].
+	off   []uint64
+	bytes []byte
+	slots []uint32
+
+	// Stem i is stemBytes[stemOff[i]:stemOff[i+1]], and its synonyms
+	// are synToks[synOff[i]:synOff[i+1]].
+	stemOff   []uint64
+	stemBytes []byte
+	synOff    []uint64
+	synToks   []token
+	stemSlots []uint32
+}
+
+// newWordTable builds a wordTable of the words and synonyms in s.
+func newWordTable(s *syndict) *wordTable {
+	t := &wordTable{off: []uint64{0}, stemOff: []uint64{0}, synOff: []uint64{0}}
+
+	for _, w := range s.d.words {
+		t.bytes = append(t.bytes, w...)
+		t.off = append(t.off, uint64(len(t.bytes)))
+	}
+
+	t.slots = hashSlots(len(s.d.words), func(i int) (string, bool) {
+		w := s.d.words[i]
+		return w, w != ""
+	})
+
+	stems := make([]string, 0, len(s.syns))
+	for stem := range s.syns {
+		stems = append(stems, stem)
+	}
+	sort.Strings(stems)
+
+	for _, stem := range stems {
+		t.stemBytes = append(t.stemBytes, stem...)
+		t.stemOff = append(t.stemOff, uint64(len(t.stemBytes)))
+
+		t.synToks = append(t.synToks, s.syns[stem].Tokens()...)
+		t.synOff = append(t.synOff, uint64(len(t.synToks)))
+	}
+
+	t.stemSlots = hashSlots(len(stems), func(i int) (string, bool) {
+		return stems[i], true
+	})
+
+	return t
+}
+
+// hashSlots returns a hash table of n keys, at most half full. key
+// returns key i, and whether it belongs in the table.
+func hashSlots(n int, key func(i int) (string, bool)) []uint32 {
+	size := 1
+	for size < 2*n {
+		size *= 2
+	}
+
+	slots := make([]uint32, size)
+	mask := uint64(size - 1)
+
+	for i := 0; i < n; i++ {
+		k, ok := key(i)
+		if !ok {
+			continue
+		}
+
+		j := fnv(k) & mask
+		for slots[j] != 0 {
+			j = (j + 1) & mask
+		}
+		slots[j] = uint32(i + 1)
+	}
+
+	return slots
+}
+
+// probe looks key up in slots, returning the index stored for it.
+// match reports whether index i holds key.
+func probe(slots []uint32, key string, match func(i int) bool) (int, bool) {
+	if len(slots) == 0 {
+		return 0, false
+	}
+
+	mask := uint64(len(slots) - 1)
+	j := fnv(key) & mask
+
+	// A damaged table might have no empty slots; don't go around
+	// more than once.
+	for range slots {
+		v := slots[j]
+		if v == 0 {
+			return 0, false
+		}
+
+		if match(int(v - 1)) {
+			return int(v - 1), true
+		}
+
+		j = (j + 1) & mask
+	}
+
+	return 0, false
+}
+
+// fnv returns the 64-bit FNV-1a hash of s.
+func fnv(s string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= 1099511628211
+	}
+
+	return h
+}
+
+// valid reports whether t's offsets are within its bytes, its synonyms
+// are its own tokens, and its hash tables can be probed.
+func (t *wordTable) valid() bool {
+	if !increasing(t.off, uint64(len(t.bytes))) || len(t.off) < 3 {
+		return false
+	}
+
+	for _, tok := range t.synToks {
+		if int(tok) >= t.len() {
+			return false
+		}
+	}
+
+	return increasing(t.stemOff, uint64(len(t.stemBytes))) &&
+		increasing(t.synOff, uint64(len(t.synToks))) &&
+		len(t.synOff) == len(t.stemOff) &&
+		powerOf2(len(t.slots)) && (len(t.stemSlots) == 0 || powerOf2(len(t.stemSlots)))
+}
+
+// increasing reports whether off starts at zero and never decreases or
+// exceeds max.
+func increasing(off []uint64, max uint64) bool {
+	if len(off) == 0 || off[0] != 0 {
+		return false
+	}
+
+	for i := 1; i < len(off); i++ {
+		if off[i] < off[i-1] {
+			return false
+		}
+	}
+
+	return off[len(off)-1] <= max
+}
+
+func powerOf2(n int) bool {
+	return n > 0 && n&(n-1) == 0
+}
+
+func (t *wordTable) len() int {
+	return len(t.off) - 1
+}
+
+// word returns the bytes of word tok, which belong to t.
+func (t *wordTable) word(tok token) []byte {
+	if int(tok) >= t.len() {
+		return nil
+	}
+
+	return t.bytes[t.off[tok]:t.off[tok+1]]
+}
+
+// id returns the token for w.
+func (t *wordTable) id(w string) (token, bool) {
+	i, ok := probe(t.slots, w, func(i int) bool {
+		return string(t.word(token(i))) == w
+	})
+
+	return token(i), ok
+}
+
+// syns returns the tokens with stem.
+func (t *wordTable) syns(stem string) []token {
+	n := len(t.stemOff) - 1
+
+	i, ok := probe(t.stemSlots, stem, func(i int) bool {
+		return i < n && string(t.stemBytes[t.stemOff[i]:t.stemOff[i+1]]) == stem
+	})
+	if !ok {
+		return nil
+	}
+
+	return t.synToks[t.synOff[i]:t.synOff[i+1]]
+}
+
+// size returns the memory used by t.
+func (t *wordTable) size() int64 {
+	return 8*int64(len(t.off)+len(t.stemOff)+len(t.synOff)) +
+		int64(len(t.bytes)+len(t.stemBytes)) +
+		4*int64(len(t.slots)+len(t.synToks)+len(t.stemSlots))
+}
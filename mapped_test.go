@@ -0,0 +1,223 @@
+package fate
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeFrozen writes a frozen copy of m to a file and opens it.
+func writeFrozen(t *testing.T, m *Model, opts Config) (*FrozenModel, []byte) {
+	var buf bytes.Buffer
+	n, err := m.Freeze().WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != int64(buf.Len()) {
+		t.Errorf("WriteTo() => %d, wrote %d bytes", n, buf.Len())
+	}
+
+	path := filepath.Join(tempDir(t), "model.fatm")
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := OpenFrozen(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+
+	return f, buf.Bytes()
+}
+
+func TestOpenFrozen(t *testing.T) {
+	rand.Seed(0)
+	sentences := corpus(vocab(200), 2000, func() int {
+		return clamp(gauss(8, 4))
+	})
+
+	// Some words that stem alike, to pivot on synonyms.
+	sentences = append(sentences, "Hello there world", "hello again, World!")
+
+	configs := []Config{
+		{},
+		{Weighted: true, Order: 4},
+		{Order: 5, Backoff: 2},
+	}
+
+	for _, cfg := range configs {
+		model := NewModel(cfg)
+		for _, sen := range sentences {
+			model.Learn(sen)
+		}
+
+		mapped, file := writeFrozen(t, model, Config{Backoff: cfg.Backoff})
+
+		want, got := model.Stats(), mapped.Stats()
+		if got.Tokens != want.Tokens || got.Bigrams != want.Bigrams ||
+			got.Trigrams != want.Trigrams || got.Contexts != want.Contexts {
+			t.Errorf("%+v: OpenFrozen().Stats() => %+v, want %+v", cfg, got, want)
+		}
+
+		queries := append(sentences[:50], "HELLO", "world", "unknown")
+		for i, q := range queries {
+			for _, o := range []ReplyOptions{{}, {MaxWords: 6}, {Candidates: 3}} {
+				o.Rand = rand.NewSource(int64(i))
+				want, err := model.ReplyCandidate(context.Background(), q, o)
+				if err != nil && err != ErrNoFit {
+					t.Fatal(err)
+				}
+
+				o.Rand = rand.NewSource(int64(i))
+				got, err2 := mapped.ReplyCandidate(context.Background(), q, o)
+				if err2 != err || !reflect.DeepEqual(got, want) {
+					t.Fatalf("%+v: mapped ReplyCandidate(%q, %+v) => %+v, %v; want %+v, %v",
+						cfg, q, o, got, err2, want, err)
+				}
+			}
+		}
+
+		// A mapped model writes the same file it was opened from.
+		var buf bytes.Buffer
+		if _, err := mapped.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), file) {
+			t.Errorf("%+v: mapped WriteTo() differs from the file", cfg)
+		}
+	}
+}
+
+func TestOpenFrozenDamaged(t *testing.T) {
+	model := NewModel(Config{})
+	model.Learn("this is a test")
+	model.Learn("this is another test")
+
+	_, file := writeFrozen(t, model, Config{})
+
+	path := filepath.Join(tempDir(t), "damaged.fatm")
+	open := func(buf []byte) error {
+		if err := ioutil.WriteFile(path, buf, 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := OpenFrozen(path, Config{Rand: rand.NewSource(1)})
+		if err == nil {
+			f.Reply("test")
+			f.Close()
+		}
+		return err
+	}
+
+	bad := append([]byte(nil), file...)
+	bad[0] = 'x'
+	if err := open(bad); err != ErrFormat {
+		t.Errorf("OpenFrozen() with a bad magic => %v, want %v", err, ErrFormat)
+	}
+
+	// Cutting off more than the checksum loses some of the model.
+	for n := 1; n < len(file)-4; n++ {
+		if err := open(file[:n]); err == nil && n < len(file)-12 {
+			t.Errorf("OpenFrozen() of %d of %d bytes succeeded", n, len(file))
+		}
+	}
+
+	// Offsets and lengths out of bounds are caught.
+	sections := mappedDictSections + 2*mappedSetsSections + 1
+	for i := 0; i < 2*sections; i++ {
+		bad := append([]byte(nil), file...)
+		bad[mappedHeader+8*i+7] ^= 0x80
+		if err := open(bad); err != ErrChecksum {
+			t.Errorf("OpenFrozen() with section table entry %d damaged => %v, want %v", i, err, ErrChecksum)
+		}
+	}
+
+	// Damage anywhere else is caught, or harmless: open replies
+	// from whatever opens, and mustn't panic.
+	weighted := NewModel(Config{Order: 4, Weighted: true})
+	weighted.Learn("this is a test")
+	weighted.Learn("this is a test of this")
+	_, counted := writeFrozen(t, weighted, Config{})
+
+	for _, file := range [][]byte{file, counted} {
+		for i := mappedHeader; i < len(file)-4; i++ {
+			for _, flip := range []byte{0x01, 0x80, 0xFF} {
+				bad := append([]byte(nil), file...)
+				bad[i] ^= flip
+				open(bad)
+			}
+		}
+	}
+}
+
+func TestSetsCheckLazily(t *testing.T) {
+	var good, bad tokset
+	good.Add(1)
+	good.Add(2)
+	bad.Add(1)
+	bad.Add(5)
+
+	var s sets
+	s.add(&good)
+	s.add(&bad)
+	s.checkLazily(3)
+
+	// Each set is checked once, when it's first read.
+	for i := 0; i < 2; i++ {
+		if set := s.get(0); set.Len() != 2 {
+			t.Errorf("get(0) => %d tokens, want 2", set.Len())
+		}
+		if set := s.get(1); set.Len() != 0 {
+			t.Errorf("get(1) with a token past the dictionary => %d tokens, want 0", set.Len())
+		}
+	}
+
+	if s.checked[0] != setValid|setInvalid<<2 {
+		t.Errorf("checked => %#x after reading both sets, want %#x", s.checked[0], setValid|setInvalid<<2)
+	}
+}
+
+func BenchmarkOpenFrozen(b *testing.B) {
+	sentences := corpus(vocab(100000), 10000, func() int {
+		return clamp(gauss(10, 5))
+	})
+
+	model := NewModel(Config{})
+	for _, sen := range sentences {
+		model.Learn(sen)
+	}
+
+	dir, err := ioutil.TempDir("", "fate")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "model.fatm")
+
+	var buf bytes.Buffer
+	if _, err := model.Freeze().WriteTo(&buf); err != nil {
+		b.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0666); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		f, err := OpenFrozen(path, Config{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		f.Close()
+	}
+}
@@ -0,0 +1,253 @@
+package fate
+
+import (
+	"math"
+	"reflect"
+	"sort"
+	"sync/atomic"
+)
+
+// Merge adds everything src has learned to dst, as if dst had learned
+// src's text too. src's words are looked up in dst's dictionary, so
+// they're stemmed with dst's Stemmer, and the successors of every
+// context are combined, adding their counts in weighted models.
+//
+// Merging models trained on parts of a corpus makes the same model as
+// learning the whole corpus, apart from the numbering of its words. The
+// models must have the same order and Tokenizer, and a weighted dst can
+// only merge a weighted src. Merging fails with ErrOverflow, leaving
+// dst as it was, if a context would be counted more than 2^32-1 times.
+//
+// src is copied as Freeze would, so it can keep being used during the
+// merge, and dst is locked as it would be for Learn. Merges aren't
+// recorded in dst's journal; save a snapshot afterwards to keep them.
+func Merge(dst, src *Model) error {
+	if dst.order != src.order {
+		return ErrOrder
+	}
+
+	if !sameTokenizer(dst.tokenizer, src.tokenizer) {
+		return ErrTokenizer
+	}
+
+	if dst.weighted && !src.weighted {
+		return ErrUnweighted
+	}
+
+	// Take src's count with the copy, so it covers the same lines.
+	src.lock.RLock()
+	f := src.freeze()
+	learned := atomic.LoadInt64(&src.count.learned)
+	src.lock.RUnlock()
+
+	dst.lock.Lock()
+	defer dst.lock.Unlock()
+
+	if !dst.mergeFits(f) {
+		return ErrOverflow
+	}
+
+	dst.merge(f)
+	atomic.AddInt64(&dst.count.learned, learned)
+
+	return nil
+}
+
+// sameTokenizer reports whether a and b split text the same way. Values
+// of a type that can't be compared are taken to be the same.
+func sameTokenizer(a, b Tokenizer) bool {
+	if reflect.TypeOf(a) != reflect.TypeOf(b) {
+		return false
+	}
+
+	return a == nil || !reflect.TypeOf(a).Comparable() || a == b
+}
+
+// mergeFits reports whether merging src, a frozen model, into m keeps
+// every count within a tokset's uint32s.
+func (m *Model) mergeFits(src *Model) bool {
+	if !m.weighted {
+		return true
+	}
+
+	f := src.chains.(*frozenChains)
+
+	// id finds src's tokens in m, without adding them: contexts
+	// with new words are new, and can't overflow.
+	id := func(tok token) (token, bool) {
+		switch tok {
+		case src.startTok:
+			return m.startTok, true
+		case src.endTok:
+			return m.endTok, true
+		}
+		return m.tokens.CheckID(src.tokens.Word(tok))
+	}
+
+	fits := func(dst *tokset, src tokset) bool {
+		return uint64(dst.Total())+uint64(src.Total()) <= math.MaxUint32
+	}
+
+	for tok := 0; tok < f.next.len(); tok++ {
+		if mtok, ok := id(token(tok)); ok && !fits(m.bi.get(mtok), f.next.get(tok)) {
+			return false
+		}
+	}
+
+	for i, ctx := range f.tri {
+		tok0, ok0 := id(ctx.tok0)
+		tok1, ok1 := id(ctx.tok1)
+		if !ok0 || !ok1 {
+			continue
+		}
+
+		if chain := m.tri.get(bigram{tok0, tok1}); chain != nil &&
+			(!fits(&chain.fwd, f.triChains.get(2*i)) || !fits(&chain.rev, f.triChains.get(2*i+1))) {
+			return false
+		}
+	}
+
+	for lvl := range f.hi {
+		level := &f.hi[lvl]
+
+	contexts:
+		for i, ctx := range level.ctxs {
+			for j := 0; j < lvl+3; j++ {
+				var ok bool
+				if ctx[j], ok = id(ctx[j]); !ok {
+					continue contexts
+				}
+			}
+
+			if chain := m.hi[lvl].get(ctx); chain != nil &&
+				(!fits(&chain.fwd, level.chains.get(2*i)) || !fits(&chain.rev, level.chains.get(2*i+1))) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// merge adds the chains of src, a frozen model, to m.
+func (m *Model) merge(src *Model) {
+	f := src.chains.(*frozenChains)
+
+	// remap takes src's tokens to m's.
+	remap := make([]token, src.tokens.Len())
+	for tok := range remap {
+		if word := src.tokens.Word(token(tok)); word != "" {
+			remap[tok] = m.tokens.ID(word)
+		}
+	}
+	remap[src.startTok], remap[src.endTok] = m.startTok, m.endTok
+
+	for tok := 0; tok < f.next.len(); tok++ {
+		next := f.next.get(tok)
+		if next.Len() == 0 {
+			continue
+		}
+
+		ctx := m.bi.get(remap[tok])
+		if ctx == nil {
+			ctx = &tokset{}
+			m.bi.put(remap[tok], ctx)
+			stats.Add("TokenLearned", 1)
+		}
+
+		ctx.merge(&next, remap, m.weighted)
+	}
+
+	for i, ctx := range f.tri {
+		ctx = bigram{remap[ctx.tok0], remap[ctx.tok1]}
+
+		chain := m.tri.get(ctx)
+		if chain == nil {
+			chain = &fwdrev{}
+			m.tri.put(ctx, chain)
+			stats.Add("BigramLearned", 1)
+		}
+
+		added := chain.merge(f.triChains.get(2*i), f.triChains.get(2*i+1), remap, m.weighted)
+		stats.Add("TrigramLearned", int64(added))
+	}
+
+	for lvl := range f.hi {
+		k := lvl + 3
+		level := &f.hi[lvl]
+
+		for i, ctx := range level.ctxs {
+			for j := 0; j < k; j++ {
+				ctx[j] = remap[ctx[j]]
+			}
+
+			chain := m.hi[lvl].get(ctx)
+			if chain == nil {
+				chain = &fwdrev{}
+				m.hi[lvl].put(ctx, chain)
+			}
+
+			chain.merge(level.chains.get(2*i), level.chains.get(2*i+1), remap, m.weighted)
+		}
+	}
+}
+
+// merge adds fwd and rev, whose tokens are mapped through remap, to c.
+// It returns how many tokens following c are new.
+func (c *fwdrev) merge(fwd, rev tokset, remap []token, counted bool) int {
+	c.rev.merge(&rev, remap, counted)
+	return c.fwd.merge(&fwd, remap, counted)
+}
+
+// merge adds the tokens of src, mapped through remap, to t. If
+// counted, it adds their counts too. It returns how many were new.
+// Both sets are sorted, so t is rebuilt in one pass.
+func (t *tokset) merge(src *tokset, remap []token, counted bool) int {
+	if src.Len() == 0 {
+		return 0
+	}
+
+	// remap doesn't keep src's order.
+	type entry struct {
+		tok   token
+		count int
+	}
+
+	adds := make([]entry, src.Len())
+	for i, tok := range src.Tokens() {
+		adds[i] = entry{remap[tok], src.Count(i)}
+	}
+	sort.Slice(adds, func(i, j int) bool { return adds[i].tok < adds[j].tok })
+
+	have := t.Tokens()
+	toks := make([]token, 0, len(have)+len(adds))
+	counts := make([]int, 0, cap(toks))
+
+	added, i, j := 0, 0, 0
+	for i < len(have) || j < len(adds) {
+		switch {
+		case j == len(adds) || i < len(have) && have[i] < adds[j].tok:
+			toks = append(toks, have[i])
+			counts = append(counts, t.Count(i))
+			i++
+		case i == len(have) || adds[j].tok < have[i]:
+			toks = append(toks, adds[j].tok)
+			counts = append(counts, adds[j].count)
+			added++
+			j++
+		default:
+			toks = append(toks, have[i])
+			counts = append(counts, t.Count(i)+adds[j].count)
+			i++
+			j++
+		}
+	}
+
+	if counted {
+		*t = countedTokset(toks, counts)
+	} else {
+		*t = uncountedTokset(toks)
+	}
+
+	return added
+}
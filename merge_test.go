@@ -0,0 +1,175 @@
+package fate
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestMerge(t *testing.T) {
+	rand.Seed(0)
+	sentences := corpus(vocab(200), 900, func() int {
+		return clamp(gauss(8, 4))
+	})
+
+	configs := []Config{
+		{},
+		{Weighted: true},
+		{Order: 5, Weighted: true},
+		{Tokenizer: PunctTokenizer},
+	}
+
+	for _, cfg := range configs {
+		want := NewModel(cfg)
+		for _, sen := range sentences {
+			want.Learn(sen)
+		}
+
+		// Learn a third of the corpus in each shard, and the
+		// shards' words in a different order than want's.
+		var shards []*Model
+		for i := 0; i < 3; i++ {
+			shard := NewModel(cfg)
+			for j := len(sentences) - 1 - i; j >= 0; j -= 3 {
+				shard.Learn(sentences[j])
+			}
+			shards = append(shards, shard)
+		}
+
+		got := shards[0]
+		for _, shard := range shards[1:] {
+			if err := Merge(got, shard); err != nil {
+				t.Fatalf("%+v: Merge() => %v", cfg, err)
+			}
+		}
+
+		ws, gs := want.Stats(), got.Stats()
+		if gs.Tokens != ws.Tokens || gs.Bigrams != ws.Bigrams || gs.Trigrams != ws.Trigrams ||
+			gs.Contexts != ws.Contexts || gs.Learned != ws.Learned {
+			t.Errorf("%+v: merged Stats() => %+v, want %+v", cfg, gs, ws)
+		}
+
+		wc, gc := chainWords(want), chainWords(got)
+		for ctx, w := range wc {
+			if g := gc[ctx]; g != w {
+				t.Fatalf("%+v: merged chain %q => %q, want %q", cfg, ctx, g, w)
+			}
+		}
+		if len(gc) != len(wc) {
+			t.Errorf("%+v: merged %d chains, want %d", cfg, len(gc), len(wc))
+		}
+
+		if cfg.Weighted {
+			for _, sen := range sentences {
+				if err := got.Forget(sen); err != nil && got.Learnable(sen) {
+					t.Fatalf("%+v: Forget(%q) after Merge => %v", cfg, sen, err)
+				}
+			}
+
+			if s := got.Stats(); s.Tokens != 0 || s.Bigrams != 0 || s.Contexts != 0 {
+				t.Errorf("%+v: Forget(everything) after Merge left %+v", cfg, s)
+			}
+		}
+	}
+}
+
+func TestMergeStemmer(t *testing.T) {
+	dst := NewModel(Config{})
+	dst.Learn("hello there")
+
+	// src doesn't think HELLO and hello are the same, but dst does.
+	src := NewModel(Config{Stemmer: exact{}})
+	src.Learn("HELLO world")
+
+	if err := Merge(dst, src); err != nil {
+		t.Fatal(err)
+	}
+
+	if syns := dst.tokens.Syns("hello"); len(syns) != 2 {
+		t.Errorf("Syns(hello) after Merge => %v, want hello and HELLO", syns)
+	}
+}
+
+type exact struct{}
+
+func (exact) Stem(s string) string { return s }
+
+func TestMergeMismatch(t *testing.T) {
+	if err := Merge(NewModel(Config{}), NewModel(Config{Order: 4})); err != ErrOrder {
+		t.Errorf("Merge(order 3, order 4) => %v, want %v", err, ErrOrder)
+	}
+
+	if err := Merge(NewModel(Config{Weighted: true}), NewModel(Config{})); err != ErrUnweighted {
+		t.Errorf("Merge(weighted, unweighted) => %v, want %v", err, ErrUnweighted)
+	}
+
+	if err := Merge(NewModel(Config{}), NewModel(Config{Weighted: true})); err != nil {
+		t.Errorf("Merge(unweighted, weighted) => %v", err)
+	}
+
+	if err := Merge(NewModel(Config{}), NewModel(Config{Tokenizer: PunctTokenizer})); err != ErrTokenizer {
+		t.Errorf("Merge(whitespace, punct) => %v, want %v", err, ErrTokenizer)
+	}
+
+	if err := Merge(NewModel(Config{Tokenizer: WhitespaceTokenizer}), NewModel(Config{})); err != nil {
+		t.Errorf("Merge(whitespace, default) => %v", err)
+	}
+}
+
+func TestMergeOverflow(t *testing.T) {
+	dst := NewModel(Config{Weighted: true})
+	dst.Learn("this is a test")
+
+	// Count "this" after <S> nearly as often as a set can.
+	tok, _ := dst.tokens.CheckID("this")
+	next := dst.bi.get(dst.startTok)
+	next.IncrBy(tok, math.MaxUint32-next.Total())
+
+	src := NewModel(Config{Weighted: true})
+	src.Learn("this is another test")
+
+	want := chainWords(dst)
+	if err := Merge(dst, src); err != ErrOverflow {
+		t.Fatalf("Merge() => %v, want %v", err, ErrOverflow)
+	}
+
+	if got := chainWords(dst); len(got) != len(want) {
+		t.Errorf("Merge() => %d chains after overflowing, want %d", len(got), len(want))
+	}
+	if s := dst.Stats(); s.Learned != 1 {
+		t.Errorf("Merge() => Learned %d after overflowing, want 1", s.Learned)
+	}
+}
+
+func TestToksetMerge(t *testing.T) {
+	// remap reverses src's tokens, so they arrive out of order.
+	remap := []token{0x1000000, 0x100, 7, 3}
+
+	for _, counted := range []bool{false, true} {
+		add := func(ts *tokset, tok token, n int) {
+			if counted {
+				ts.IncrBy(tok, n)
+			} else {
+				ts.Add(tok)
+			}
+		}
+
+		var dst, src, want tokset
+		for _, tok := range []token{3, 5, 0x100} {
+			add(&dst, tok, int(tok%4)+1)
+			add(&want, tok, int(tok%4)+1)
+		}
+		for tok := token(0); tok < 4; tok++ {
+			add(&src, tok, int(tok)+1)
+			add(&want, remap[tok], int(tok)+1)
+		}
+
+		if added := dst.merge(&src, remap, counted); added != 2 {
+			t.Errorf("counted=%v: merge() => %d new tokens, want 2", counted, added)
+		}
+		if !reflect.DeepEqual(dst, want) {
+			t.Errorf("counted=%v: merge() => %+v, want %+v", counted, dst, want)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+//go:build linux
+// +build linux
+
+package fate
+
+import (
+	"os"
+	"syscall"
+)
+
+// mapFile maps the file at path into memory, read-only and shared with
+// anything else that maps it. The returned func unmaps it.
+func mapFile(path string) ([]byte, func() error, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	size := info.Size()
+	if size == 0 || size != int64(int(size)) {
+		return nil, nil, ErrFormat
+	}
+
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return data, func() error { return syscall.Munmap(data) }, nil
+}
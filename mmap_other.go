@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package fate
+
+import "io/ioutil"
+
+// mapFile reads the file at path into memory. Without mmap, nothing is
+// shared with other processes, but the file is still used in place.
+func mapFile(path string) ([]byte, func() error, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return data, func() error { return nil }, nil
+}
@@ -2,13 +2,17 @@
 package fate
 
 import (
+	"context"
 	cryptorand "crypto/rand"
 	"encoding/binary"
+	"errors"
 	"expvar"
-	"log"
+	"fmt"
 	"math/rand"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 	"unicode"
 )
 
@@ -23,11 +27,68 @@ func (b bigram) reverse() bigram {
 }
 
 var (
+	// stats totals activity across every Model in the process. See
+	// Model.Stats for a single model.
 	stats = expvar.NewMap("fate")
+
+	// lastID is the id of the most recently created Model.
+	lastID uint64
+)
+
+var (
+	// ErrUnweighted is returned by Forget on models that don't
+	// count their observations. Those can't tell whether anything
+	// else was learned from the same trigrams. Merge returns it when
+	// merging such a model into a weighted one.
+	ErrUnweighted = errors.New("fate: model isn't weighted")
+
+	// ErrOrder is returned by Merge when the models have different
+	// orders.
+	ErrOrder = errors.New("fate: models have different orders")
+
+	// ErrTokenizer is returned by Merge when the models split text
+	// into words differently.
+	ErrTokenizer = errors.New("fate: models have different tokenizers")
+
+	// ErrOverflow is returned by Merge when a merged context would
+	// be counted too many times.
+	ErrOverflow = errors.New("fate: merged counts overflow")
+
+	// ErrNotLearned is returned by Forget when the text was never
+	// learned.
+	ErrNotLearned = errors.New("fate: text wasn't learned")
+
+	// ErrTooLong is returned when every reply walk ran past
+	// Config.MaxPath words.
+	ErrTooLong = errors.New("fate: reply too long")
+
+	// ErrNoFit is returned by ReplyWith when no reply could be found
+	// within its ReplyOptions.
+	ErrNoFit = errors.New("fate: no reply fits the options")
+
+	// ErrDeadEnd is matched by every *DeadEndError, for use with
+	// errors.Is.
+	ErrDeadEnd = errors.New("fate: ran out of chain")
 )
 
-// Model is a trigram language model that can learn and respond to
-// text.
+// DeadEndError is returned when a reply walks into a context that
+// nothing has been seen to follow or precede. That means the model is
+// inconsistent, e.g. after loading a damaged snapshot.
+type DeadEndError struct {
+	// Context holds the words of the context that ended the walk.
+	Context []string
+}
+
+func (e *DeadEndError) Error() string {
+	return fmt.Sprintf("fate: ran out of chain at %q", strings.Join(e.Context, " "))
+}
+
+func (e *DeadEndError) Unwrap() error {
+	return ErrDeadEnd
+}
+
+// Model is an n-gram language model that can learn and respond to
+// text. By default, it's a trigram model.
 type Model struct {
 	tokens   *syndict
 	startTok token
@@ -41,8 +102,44 @@ type Model struct {
 
 	tri trigrams
 
-	lock *sync.RWMutex
-	rand *prng
+	// Models with an order above 3 also track longer contexts:
+	// hi[0] has contexts of length 3, hi[1] of length 4, etc.
+	hi      []ngrams
+	order   int
+	backoff int
+
+	// weighted models count observations and choose successors in
+	// proportion to their counts.
+	weighted bool
+	maxPath  int
+
+	// A nil tokenizer means the default, WhitespaceTokenizer.
+	tokenizer   Tokenizer
+	detokenizer Detokenizer
+
+	journal *Journal
+
+	// journaled is the sequence number of the first journal record
+	// the model hasn't learned, as read from its snapshot.
+	journaled uint64
+
+	// chains is what replies read: bi, tri and hi for a model that
+	// learns, or a frozen model's or a Blend's chains in their place.
+	chains chains
+
+	// stripes is set while LearnAll's workers share the model.
+	stripes *stripes
+
+	// scratch holds the tokens of the line Learn is learning.
+	scratch []token
+
+	// id orders the locks of models locked together: a Blend
+	// read locks its models in increasing id order.
+	id uint64
+
+	lock  *sync.RWMutex
+	rand  *prng
+	count *counters
 }
 
 // Config holds Model configuration data. An empty Config struct
@@ -52,8 +149,53 @@ type Config struct {
 	// when created. Words that stem the same mean the same thing.
 	Stemmer Stemmer
 	Rand    rand.Source
+
+	// Weighted makes the model count how often each word follows
+	// (and precedes) each context, and choose among them in
+	// proportion to those counts. This uses more memory than the
+	// default, which chooses uniformly among everything seen.
+	Weighted bool
+
+	// MaxPath caps the number of words in a reply. Walks that grow
+	// longer, e.g. around a cycle in the chains, are abandoned.
+	// Defaults to DefaultMaxPath.
+	MaxPath int
+
+	// Order is the n-gram order of the model, from 3 (trigrams,
+	// the default) to MaxOrder. Replies are generated from the
+	// previous Order-1 words where possible, backing off to
+	// shorter contexts when the longer ones haven't been seen.
+	// NewModel panics if Order is out of range.
+	Order int
+
+	// Tokenizer splits text into words, and Detokenizer joins
+	// them back together in replies. Tokenizer defaults to
+	// WhitespaceTokenizer. Detokenizer defaults to the Tokenizer,
+	// if it's also a Detokenizer, or else WhitespaceTokenizer.
+	Tokenizer   Tokenizer
+	Detokenizer Detokenizer
+
+	// Backoff is the number of successors a context longer than a
+	// bigram needs for it to be used; contexts with fewer back off
+	// to shorter ones. Raising it trades coherence for variety.
+	// Defaults to 1.
+	Backoff int
+
+	// Journal, if set, records everything the model learns and
+	// forgets, so it can be replayed after a crash. See Journal.
+	Journal *Journal
+
+	// Expvar, if set, publishes the model's Stats with expvar under
+	// this name. A name can be published again by a later model,
+	// e.g. one reloaded from a snapshot, which replaces the first.
+	// NewModel panics if the name is used by another expvar.
+	Expvar string
 }
 
+// DefaultMaxPath is the default reply length cap: far longer than any
+// reasonable reply.
+const DefaultMaxPath = 1000
+
 func (c Config) stemmerOrDefault() Stemmer {
 	if c.Stemmer != nil {
 		return c.Stemmer
@@ -62,6 +204,54 @@ func (c Config) stemmerOrDefault() Stemmer {
 	return DefaultStemmer
 }
 
+func (c Config) maxPathOrDefault() int {
+	if c.MaxPath > 0 {
+		return c.MaxPath
+	}
+
+	return DefaultMaxPath
+}
+
+func (c Config) orderOrDefault() int {
+	if c.Order == 0 {
+		return 3
+	}
+
+	if c.Order < 3 || c.Order > MaxOrder {
+		panic(fmt.Sprintf("fate: Order %d out of range [3, %d]", c.Order, MaxOrder))
+	}
+
+	return c.Order
+}
+
+func (c Config) backoffOrDefault() int {
+	if c.Backoff > 0 {
+		return c.Backoff
+	}
+
+	return 1
+}
+
+func (c Config) tokenizerOrDefault() Tokenizer {
+	if c.Tokenizer == WhitespaceTokenizer {
+		return nil
+	}
+
+	return c.Tokenizer
+}
+
+func (c Config) detokenizerOrDefault() Detokenizer {
+	if c.Detokenizer != nil {
+		return c.Detokenizer
+	}
+
+	if d, ok := c.Tokenizer.(Detokenizer); ok {
+		return d
+	}
+
+	return WhitespaceTokenizer
+}
+
 func (c Config) randOrDefault() rand.Source {
 	if c.Rand != nil {
 		return c.Rand
@@ -74,47 +264,99 @@ func (c Config) randOrDefault() rand.Source {
 
 // NewModel constructs an empty language model.
 func NewModel(opts Config) *Model {
+	order := opts.orderOrDefault()
 	seed := opts.randOrDefault().Int63()
 	tokens := newSyndict(opts.stemmerOrDefault())
 
-	return &Model{
+	m := &Model{
 		tokens:   tokens,
 		startTok: tokens.ID("<S>"),
 		endTok:   tokens.ID("</S>"),
 
-		bi:  make(bigrams),
-		tri: make(trigrams),
+		hi:      make([]ngrams, order-3),
+		order:   order,
+		backoff: opts.backoffOrDefault(),
+
+		weighted: opts.Weighted,
+		maxPath:  opts.maxPathOrDefault(),
 
-		lock: &sync.RWMutex{},
-		rand: &prng{uint64(seed)},
+		tokenizer:   opts.tokenizerOrDefault(),
+		detokenizer: opts.detokenizerOrDefault(),
+
+		journal: opts.Journal,
+
+		id:    atomic.AddUint64(&lastID, 1),
+		lock:  &sync.RWMutex{},
+		rand:  &prng{uint64(seed)},
+		count: &counters{},
 	}
+
+	m.chains = (*liveChains)(m)
+
+	if opts.Expvar != "" {
+		m.publish(opts.Expvar)
+	}
+
+	return m
 }
 
 // Learn observes the text in a string and makes it available for
 // later replies.
 func (m *Model) Learn(text string) {
-	if !learnable(text) {
-		// Refuse to learn single-word inputs.
+	m.learn(text, true)
+}
+
+// learn is Learn, appending text to the model's journal if record is
+// set.
+func (m *Model) learn(text string, record bool) {
+	// Refuse to learn single-word inputs. The default tokenizer
+	// doesn't need to split the text first.
+	var words []string
+	if m.tokenizer != nil {
+		words = m.tokenizer.Tokenize(text)
+		if len(words) < 2 {
+			return
+		}
+	} else if !learnable(text) {
 		return
 	}
 
+	m.lock.Lock()
+
+	toks := m.scratch[:0]
+	if m.tokenizer != nil {
+		for _, word := range words {
+			toks = append(toks, m.tokens.ID(word))
+		}
+	} else {
+		iter := newWords(text)
+		for iter.Next() {
+			toks = append(toks, m.tokens.ID(iter.Word()))
+		}
+	}
+	m.scratch = toks
+
+	m.observeLine(toks)
+
+	if record && m.journal != nil {
+		m.journal.append(recordLearn, text)
+	}
+
+	stats.Add("Learned", 1)
+	atomic.AddInt64(&m.count.learned, 1)
+
+	m.lock.Unlock()
+}
+
+// observeLine records everything learned from a line of toks.
+func (m *Model) observeLine(toks []token) {
 	start, end := m.startTok, m.endTok
 
 	// Maintain a four-token sliding window. This allows us to learn
 	// both the forward and reverse directions from the {tok1, tok2}
 	// bigram at the same time.
-	var (
-		tok0 token = start
-		tok1 token = start
-		tok2 token = start
-		tok3 token = 0
-	)
-
-	iter := newWords(text)
-
-	m.lock.Lock()
-	for iter.Next() {
-		tok3 = m.tokens.ID(iter.Word())
+	tok0, tok1, tok2 := start, start, start
+	for _, tok3 := range toks {
 		m.observe(tok0, tok1, tok2, tok3)
 		tok0, tok1, tok2 = tok1, tok2, tok3
 	}
@@ -128,9 +370,124 @@ func (m *Model) Learn(text string) {
 	m.observe(tok1, tok2, end, end)
 	m.observe(tok2, end, end, end)
 
-	stats.Add("Learned", 1)
+	// Longer contexts are learned from the whole line at once.
+	if len(m.hi) > 0 {
+		m.observeLonger(toks)
+	}
+}
 
-	m.lock.Unlock()
+// Forget reverses a previous Learn of text, removing it from the
+// trigram and bigram counts. Contexts that are left empty are removed,
+// and words that no longer appear anywhere are dropped from the
+// dictionary so they can't be used in replies.
+//
+// Forget requires a Weighted model. It returns ErrNotLearned and
+// leaves the model untouched if text hasn't been learned.
+func (m *Model) Forget(text string) error {
+	return m.forget(text, true)
+}
+
+// forget is Forget, appending text to the model's journal if record is
+// set.
+func (m *Model) forget(text string, record bool) error {
+	if !m.weighted {
+		return ErrUnweighted
+	}
+
+	words := m.split(text)
+	if len(words) < 2 {
+		// Nothing was learned.
+		return nil
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var toks []token
+	for _, word := range words {
+		tok, ok := m.tokens.CheckID(word)
+		if !ok {
+			return ErrNotLearned
+		}
+		toks = append(toks, tok)
+	}
+
+	obs := m.windows(toks)
+	if !m.learned(obs) {
+		return ErrNotLearned
+	}
+
+	for _, w := range obs {
+		if w.k > 2 {
+			m.hi[w.k-3].Forget(w.ctx, w.prev, w.next)
+			continue
+		}
+
+		m.tri.Forget(w.prev, w.ctx[0], w.ctx[1], w.next)
+
+		tok := w.ctx[0]
+		if m.bi.Forget(tok, w.ctx[1]) && tok != m.startTok && tok != m.endTok {
+			m.tokens.Remove(tok)
+		}
+	}
+
+	if record && m.journal != nil {
+		m.journal.append(recordForget, text)
+	}
+
+	stats.Add("Forgot", 1)
+	atomic.AddInt64(&m.count.forgot, 1)
+
+	return nil
+}
+
+// learned reports whether every window in obs has been observed, at
+// least as many times as it occurs in obs.
+func (m *Model) learned(obs []window) bool {
+	type key struct {
+		k   int
+		ctx ngram
+		tok token
+		rev bool
+	}
+
+	seen := make(map[key]int)
+	for _, w := range obs {
+		chain := m.chain(w)
+		if chain == nil {
+			return false
+		}
+
+		fwd := key{w.k, w.ctx, w.next, false}
+		rev := key{w.k, w.ctx, w.prev, true}
+		seen[fwd]++
+		seen[rev]++
+
+		if chain.fwd.CountOf(w.next) < seen[fwd] || chain.rev.CountOf(w.prev) < seen[rev] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// split tokenizes text with the model's Tokenizer.
+func (m *Model) split(text string) []string {
+	if m.tokenizer != nil {
+		return m.tokenizer.Tokenize(text)
+	}
+
+	return WhitespaceTokenizer.Tokenize(text)
+}
+
+// Learnable reports whether Learn would learn from text. Text with
+// fewer than two words is ignored.
+func (m *Model) Learnable(text string) bool {
+	if m.tokenizer != nil {
+		return len(m.tokenizer.Tokenize(text)) > 1
+	}
+
+	return learnable(text)
 }
 
 func learnable(s string) bool {
@@ -152,9 +509,18 @@ func learnable(s string) bool {
 }
 
 func (m *Model) observe(tok0, tok1, tok2, tok3 token) {
-	// Observe the trigram: (tok0, tok1, tok2).
-	if !m.tri.Observe(tok0, tok1, tok2, tok3) {
-		m.bi.Observe(tok1, tok2)
+	// Observe the trigram: (tok0, tok1, tok2). Weighted models
+	// count every bigram so contexts are chosen by frequency too.
+	shard := bigram{tok1, tok2}.shard()
+	m.stripes.lock(1, shard)
+	had2 := m.tri.Observe(tok0, tok1, tok2, tok3, m.weighted)
+	m.stripes.unlock(1, shard)
+
+	if !had2 || m.weighted {
+		shard = tok1.shard()
+		m.stripes.lock(0, shard)
+		m.bi.Observe(tok1, tok2, m.weighted)
+		m.stripes.unlock(0, shard)
 	}
 }
 
@@ -162,39 +528,220 @@ func (m *Model) observe(tok0, tok1, tok2, tok3 token) {
 // the language model. If no text has been learned, returns an empty
 // string.
 func (m *Model) Reply(text string) string {
-	m.lock.RLock()
-	defer m.lock.RUnlock()
+	reply, _ := m.ReplyErr(text)
+	return reply
+}
+
+// ReplyErr is like Reply, but also returns an error if no reply could
+// be generated. If the walk from one pivot runs into a dead end,
+// another is tried; the returned *DeadEndError describes the last one
+// if they all fail.
+func (m *Model) ReplyErr(text string) (string, error) {
+	return m.ReplyContext(context.Background(), text)
+}
+
+// ReplyContext is like ReplyErr, but stops walking and returns
+// ctx.Err() if ctx is done before a reply is found.
+func (m *Model) ReplyContext(ctx context.Context, text string) (string, error) {
+	return m.ReplyWith(ctx, text, ReplyOptions{})
+}
 
-	if m.tokens.Len() <= 2 {
-		return ""
+// ReplyOptions constrains the length of a reply. Zero values mean no
+// constraint.
+type ReplyOptions struct {
+	// MinWords and MaxWords bound the number of words in a reply.
+	MinWords int
+	MaxWords int
+
+	// MaxBytes bounds the length of a reply in bytes, counting the
+	// spaces between words.
+	MaxBytes int
+
+	// Candidates and Budget make ReplyWith generate several
+	// replies and return the one Scorer rates highest. It stops
+	// after Candidates replies or when Budget has elapsed,
+	// whichever comes first; a zero value means no limit, but one
+	// of them must be set.
+	Candidates int
+	Budget     time.Duration
+
+	// Scorer rates candidate replies. Defaults to DefaultScorer.
+	Scorer Scorer
+
+	// Rand, if set, makes the reply's random choices instead of the
+	// model's source, so a reply can be repeated by seeding it the
+	// same way. It's only used by the calling goroutine.
+	Rand rand.Source
+}
+
+func (o ReplyOptions) limited() bool {
+	return o.MinWords > 0 || o.MaxWords > 0 || o.MaxBytes > 0
+}
+
+// ReplyWith is like ReplyContext, but the reply must also satisfy
+// opts. Rather than generating whole replies until one fits, the walk
+// prefers to end the sentence as it nears the limits and backtracks
+// out of branches that can't end within them. If no reply fits,
+// returns ErrNoFit.
+func (m *Model) ReplyWith(ctx context.Context, text string, opts ReplyOptions) (string, error) {
+	c, err := m.ReplyCandidate(ctx, text, opts)
+	if c == nil || err != nil {
+		return "", err
 	}
 
-	tokens := m.conflate(strings.Fields(text))
-	reply := join(m.tokens, m.replyTokens(tokens, &prng{m.rand.Next()}))
+	return c.Text, nil
+}
+
+// ReplyCandidate is like ReplyWith, but returns the reply as a
+// Candidate, with its words and the pivot it was generated from. It
+// returns nil if the model is empty.
+func (m *Model) ReplyCandidate(ctx context.Context, text string, opts ReplyOptions) (*Candidate, error) {
+	if opts.Candidates > 1 || opts.Budget > 0 {
+		return m.replyBest(ctx, text, opts)
+	}
+
+	c, err := m.candidate(ctx, m.split(text), opts, false)
+	if c == nil || err != nil {
+		return nil, err
+	}
 
 	stats.Add("Replied", 1)
+	atomic.AddInt64(&m.count.replied, 1)
 
-	return reply
+	return c, nil
 }
 
-func (m *Model) replyTokens(tokens []token, r intn) []token {
-	var pivot token
-	if len(tokens) > 0 {
-		pivot = choice(tokens, r)
-	} else {
-		// Babble. Assume tokens 0 & 1 are start and end.
-		pivot = token(r.Intn(m.tokens.Len()-2) + 2)
+// ReplyStream is like ReplyContext, but calls fn with each word of
+// the reply as it's generated, in the order they appear. It returns
+// the whole reply, which is the words fn saw, detokenized.
+//
+// If fn returns an error, generation stops and ReplyStream returns it.
+// A reply that goes wrong after its first word has been sent can't be
+// retried from another pivot, so its error is returned too.
+//
+// fn is called with the model's read lock held, so it shouldn't block
+// for long, and mustn't learn or forget.
+func (m *Model) ReplyStream(ctx context.Context, text string, fn func(word string) error) (string, error) {
+	m.chains.rlock()
+	defer m.chains.runlock()
+
+	if m.chains.empty() {
+		return "", nil
+	}
+
+	tokens := m.conflate(m.split(text))
+
+	path, _, err := m.replyTokens(ctx, tokens, &prng{m.rand.Next()}, ReplyOptions{}, &emitter{fn: fn})
+	if err != nil {
+		return "", err
+	}
+
+	stats.Add("Replied", 1)
+	atomic.AddInt64(&m.count.replied, 1)
+
+	_, reply := m.join(path)
+	return reply, nil
+}
+
+// candidate generates a single reply to words, or nil if the model is
+// empty. If score is set, it also measures the reply's Surprise.
+func (m *Model) candidate(ctx context.Context, words []string, opts ReplyOptions, score bool) (*Candidate, error) {
+	m.chains.rlock()
+	defer m.chains.runlock()
+
+	if m.chains.empty() {
+		return nil, nil
+	}
+
+	tokens := m.conflate(words)
+
+	seed := m.rand.Next()
+	if opts.Rand != nil {
+		seed = uint64(opts.Rand.Int63())
+	}
+
+	path, pivot, err := m.replyTokens(ctx, tokens, &prng{seed}, opts, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Candidate{Input: words, Pivot: m.tokens.Word(pivot)}
+	c.Words, c.Text = m.join(path)
+
+	if score {
+		c.Surprise = m.surprise(path)
+	}
+
+	return c, nil
+}
+
+// maxPivots limits the number of pivots tried for a single reply.
+const maxPivots = 10
+
+// replyTokens returns a reply to tokens and the pivot it was grown
+// from. If emit is set, the reply's words are sent to it as they're
+// walked.
+func (m *Model) replyTokens(ctx context.Context, tokens []token, r intn, opts ReplyOptions, emit *emitter) ([]token, token, error) {
+	var err error
+	for i := 0; i < maxPivots; i++ {
+		var pivot token
+		if len(tokens) > 0 {
+			// Don't try the same pivot twice.
+			n := r.Intn(len(tokens))
+			pivot = tokens[n]
+			tokens[n] = tokens[len(tokens)-1]
+			tokens = tokens[:len(tokens)-1]
+		} else {
+			pivot = m.babble(r)
+		}
+
+		var path []token
+		if opts.limited() {
+			path, err = m.search(ctx, pivot, r, opts)
+		} else {
+			path, err = m.walk(ctx, pivot, r, emit)
+		}
+
+		if err == nil {
+			return path, pivot, nil
+		}
+
+		if errors.Is(err, ErrDeadEnd) {
+			stats.Add("DeadEnd", 1)
+			atomic.AddInt64(&m.count.deadEnds, 1)
+		}
+
+		switch {
+		case emit != nil && emit.sent:
+			// Words are out already; too late to start over.
+			return nil, 0, err
+		case !errors.Is(err, ErrDeadEnd) && err != ErrTooLong && err != ErrNoFit:
+			return nil, 0, err
+		}
 	}
 
-	fwdctx := bigram{tok0: pivot, tok1: m.bi[pivot].Choice(r)}
+	return nil, 0, err
+}
+
+func (m *Model) walk(ctx context.Context, pivot token, r intn, emit *emitter) ([]token, error) {
+	next := m.chains.nextSet(pivot)
+	if next.Len() == 0 {
+		return nil, m.deadEnd(pivot)
+	}
+
+	fwdctx := bigram{tok0: pivot, tok1: next.Choice(r)}
 
 	start, end := m.startTok, m.endTok
 
 	var path []token
+	var err error
 
 	// Compute the beginning of the sentence by walking from
 	// fwdctx back to start.
-	path = m.followrev(path, m.tri, fwdctx, start)
+	path, err = m.followrev(ctx, path, fwdctx, start, r)
+	if err != nil {
+		return nil, err
+	}
 
 	// Reverse what we have so far.
 	reverse(path)
@@ -208,13 +755,65 @@ func (m *Model) replyTokens(tokens []token, r intn) []token {
 	// And tok1 only if we weren't already at the end.
 	if fwdctx.tok1 != end {
 		path = append(path, fwdctx.tok1)
+	}
+
+	if len(path) > m.maxPath {
+		return nil, ErrTooLong
+	}
 
+	// The beginning of the sentence is settled now.
+	if err := emit.send(m, path...); err != nil {
+		return nil, err
+	}
+
+	if fwdctx.tok1 != end {
 		// Compute the end of the sentence by walking forward
 		// from fwdctx to end.
-		path = m.followfwd(path, m.tri, fwdctx, end)
+		path, err = m.followfwd(ctx, path, fwdctx, end, r, emit)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return path, nil
+}
+
+// emitter sends the words of a reply to a ReplyStream callback.
+type emitter struct {
+	fn   func(word string) error
+	sent bool
+}
+
+// send calls e's callback with the words of toks, if e isn't nil.
+func (e *emitter) send(m *Model, toks ...token) error {
+	if e == nil {
+		return nil
+	}
+
+	for _, tok := range toks {
+		e.sent = true
+		if err := e.fn(m.tokens.Word(tok)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// babble chooses a random learned token as a pivot.
+func (m *Model) babble(r intn) token {
+	// Assume tokens 0 & 1 are start and end. Forgotten tokens
+	// have no bigrams, so skip ahead to the next one that does.
+	n := m.tokens.Len() - 2
+	pivot := r.Intn(n)
+	for i := 0; i < n; i++ {
+		tok := token((pivot+i)%n + 2)
+		if next := m.chains.nextSet(tok); next.Len() > 0 {
+			return tok
+		}
 	}
 
-	return path
+	return m.startTok
 }
 
 func (m *Model) conflate(words []string) []token {
@@ -241,33 +840,77 @@ func in(haystack []token, needle token) bool {
 	return false
 }
 
-func (m *Model) followfwd(path []token, tri trigrams, pos bigram, goal token) []token {
+// followfwd walks forward from the end of path, which must hold at
+// least the pivot context, to goal.
+func (m *Model) followfwd(ctx context.Context, path []token, pos bigram, goal token, r intn, emit *emitter) ([]token, error) {
+	var ext []token
+
+	done := ctx.Done()
 	for {
-		toks := tri.Fwd(pos)
+		select {
+		case <-done:
+			return path, ctx.Err()
+		default:
+		}
+
+		if len(m.hi) > 0 {
+			ext = m.fwdExt(ext, path)
+		}
+
+		toks := m.fwdSet(pos, ext)
 		if toks.Len() == 0 {
-			log.Fatal("ran out of chain at", pos)
+			return path, m.deadEnd(pos.tok0, pos.tok1)
 		}
 
-		tok := toks.Choice(m.rand)
+		tok := toks.Choice(r)
 		if tok == goal {
-			return path
+			return path, nil
+		}
+
+		if len(path) >= m.maxPath {
+			return path, ErrTooLong
 		}
 
 		path = append(path, tok)
 		pos.tok0, pos.tok1 = pos.tok1, tok
+
+		if err := emit.send(m, tok); err != nil {
+			return path, err
+		}
 	}
 }
 
-func (m *Model) followrev(path []token, tri trigrams, pos bigram, goal token) []token {
+// followrev walks backward from the pivot context fwdctx to goal,
+// appending to path in reverse order.
+func (m *Model) followrev(ctx context.Context, path []token, fwdctx bigram, goal token, r intn) ([]token, error) {
+	var ext []token
+
+	pos := fwdctx
+
+	done := ctx.Done()
 	for {
-		toks := tri.Rev(pos)
+		select {
+		case <-done:
+			return path, ctx.Err()
+		default:
+		}
+
+		if len(m.hi) > 0 {
+			ext = m.revExt(ext, path, fwdctx)
+		}
+
+		toks := m.revSet(pos, ext)
 		if toks.Len() == 0 {
-			log.Fatal("ran out of chain at", pos)
+			return path, m.deadEnd(pos.tok0, pos.tok1)
 		}
 
-		tok := toks.Choice(m.rand)
+		tok := toks.Choice(r)
 		if tok == goal {
-			return path
+			return path, nil
+		}
+
+		if len(path) >= m.maxPath {
+			return path, ErrTooLong
 		}
 
 		path = append(path, tok)
@@ -275,20 +918,24 @@ func (m *Model) followrev(path []token, tri trigrams, pos bigram, goal token) []
 	}
 }
 
-func join(tokens *syndict, path []token) string {
-	if len(path) == 0 {
-		return ""
+func (m *Model) deadEnd(ctx ...token) error {
+	words := make([]string, 0, len(ctx))
+	for _, tok := range ctx {
+		words = append(words, m.tokens.Word(tok))
 	}
 
-	buf := make([]byte, 0, joinsize(tokens, path))
+	return &DeadEndError{Context: words}
+}
 
-	buf = append(buf, tokens.Word(path[0])...)
-	for _, tok := range path[1:] {
-		buf = append(buf, ' ')
-		buf = append(buf, tokens.Word(tok)...)
+// join returns the words of path, and the text the model's
+// Detokenizer makes of them.
+func (m *Model) join(path []token) ([]string, string) {
+	words := make([]string, 0, len(path))
+	for _, tok := range path {
+		words = append(words, m.tokens.Word(tok))
 	}
 
-	return string(buf)
+	return words, m.detokenizer.Detokenize(words)
 }
 
 func reverse(toks []token) {
@@ -299,17 +946,3 @@ func reverse(toks []token) {
 		b--
 	}
 }
-
-func joinsize(tokens *syndict, path []token) int {
-	// initialize count assuming a space between each word
-	count := len(path) - 1
-	for _, tok := range path {
-		count += len(tokens.Word(tok))
-	}
-
-	return count
-}
-
-func choice(toks []token, r intn) token {
-	return toks[r.Intn(len(toks))]
-}
@@ -2,6 +2,9 @@ package fate
 
 import (
 	"bufio"
+	"context"
+	"errors"
+	"math/rand"
 	"os"
 	"strings"
 	"testing"
@@ -121,3 +124,272 @@ func BenchmarkOverhead(b *testing.B) {
 		m.Learn(quote)
 	}
 }
+
+func TestWeighted(t *testing.T) {
+	model := NewModel(Config{Weighted: true})
+
+	for i := 0; i < 9; i++ {
+		model.Learn("this is a test")
+	}
+	model.Learn("this is another test")
+
+	var a int
+	for i := 0; i < 1000; i++ {
+		reply := model.Reply("this")
+
+		switch reply {
+		case "this is a test":
+			a++
+		case "this is another test":
+		default:
+			t.Fatalf("Reply(this) => %s, want %s", reply, "this is (a|another) test")
+		}
+	}
+
+	if a < 800 {
+		t.Errorf("Reply(this) chose the common reply %d/1000 times, want about 900", a)
+	}
+}
+
+func TestForget(t *testing.T) {
+	model := NewModel(Config{Weighted: true})
+
+	model.Learn("this is a test")
+	model.Learn("this is another test")
+	model.Learn("this is another test")
+
+	if err := model.Forget("this is another test"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Learned twice, so "another" should still be there.
+	if _, ok := model.tokens.CheckID("another"); !ok {
+		t.Fatalf("Forget() removed a token that is still learned")
+	}
+
+	if err := model.Forget("this is another test"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := model.tokens.CheckID("another"); ok {
+		t.Fatalf("Forget() kept a token that was completely forgotten")
+	}
+
+	for i := 0; i < 1000; i++ {
+		reply := model.Reply("")
+		if reply != "this is a test" {
+			t.Fatalf("Reply() => %s, want %s", reply, "this is a test")
+		}
+	}
+
+	if err := model.Forget("this is another test"); err != ErrNotLearned {
+		t.Errorf("Forget(unlearned) => %v, want %v", err, ErrNotLearned)
+	}
+
+	if err := model.Forget("this is a test"); err != nil {
+		t.Fatal(err)
+	}
+
+	if model.bi.len() != 0 || model.tri.len() != 0 {
+		t.Errorf("Forget(everything) left %d bigrams and %d contexts", model.bi.len(), model.tri.len())
+	}
+
+	if reply := model.Reply("this"); reply != "" {
+		t.Errorf("Reply() => %s, want empty string", reply)
+	}
+}
+
+func TestForgetUnweighted(t *testing.T) {
+	model := NewModel(Config{})
+	model.Learn("this is a test")
+
+	if err := model.Forget("this is a test"); err != ErrUnweighted {
+		t.Errorf("Forget() => %v, want %v", err, ErrUnweighted)
+	}
+}
+
+func TestReplyDeadEnd(t *testing.T) {
+	model := NewModel(Config{})
+	model.Learn("foo bar baz")
+	model.Learn("qux quux corge")
+
+	// Break the first chain, as a damaged snapshot might.
+	bar, _ := model.tokens.CheckID("bar")
+	baz, _ := model.tokens.CheckID("baz")
+	delete(model.tri[bigram{bar, baz}.shard()], bigram{bar, baz})
+
+	for i := 0; i < 100; i++ {
+		reply, err := model.ReplyErr("bar qux")
+		if err != nil || reply != "qux quux corge" {
+			t.Fatalf("ReplyErr(bar qux) => %q, %v, want %q", reply, err, "qux quux corge")
+		}
+	}
+
+	// With only the broken chain left, every pivot fails.
+	model = NewModel(Config{})
+	model.Learn("foo bar baz")
+	delete(model.tri[bigram{bar, baz}.shard()], bigram{bar, baz})
+
+	_, err := model.ReplyErr("bar")
+	if !errors.Is(err, ErrDeadEnd) {
+		t.Fatalf("ReplyErr(bar) => %v, want %v", err, ErrDeadEnd)
+	}
+
+	var dead *DeadEndError
+	if !errors.As(err, &dead) || len(dead.Context) != 2 {
+		t.Errorf("ReplyErr(bar) => %#v, want a *DeadEndError with a bigram", err)
+	}
+}
+
+func TestReplyContext(t *testing.T) {
+	model := NewModel(Config{})
+	model.Learn("this is a test")
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	reply, err := model.ReplyContext(ctx, "this")
+	if err != nil || reply != "this is a test" {
+		t.Fatalf("ReplyContext(this) => %q, %v, want %q", reply, err, "this is a test")
+	}
+
+	cancel()
+
+	_, err = model.ReplyContext(ctx, "this")
+	if err != context.Canceled {
+		t.Errorf("ReplyContext(canceled) => %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestMaxPath(t *testing.T) {
+	model := NewModel(Config{MaxPath: 3})
+	model.Learn("one two three four five six")
+
+	_, err := model.ReplyErr("one")
+	if err != ErrTooLong {
+		t.Errorf("ReplyErr(one) => %v, want %v", err, ErrTooLong)
+	}
+}
+
+func TestMaxPathBoundary(t *testing.T) {
+	const text = "one two three four five six"
+
+	// Walking forward from one, and backward from six.
+	for _, pivot := range []string{"one", "six"} {
+		model := NewModel(Config{MaxPath: 6})
+		model.Learn(text)
+
+		if reply, err := model.ReplyErr(pivot); reply != text || err != nil {
+			t.Errorf("MaxPath 6: ReplyErr(%s) => %q, %v; want %q", pivot, reply, err, text)
+		}
+
+		model = NewModel(Config{MaxPath: 5})
+		model.Learn(text)
+
+		var words []string
+		_, err := model.ReplyStream(context.Background(), pivot, func(word string) error {
+			words = append(words, word)
+			return nil
+		})
+		if err != ErrTooLong || len(words) > 5 {
+			t.Errorf("MaxPath 5: ReplyStream(%s) => %v after %q, want %v", pivot, err, words, ErrTooLong)
+		}
+	}
+}
+
+func TestReplyCandidate(t *testing.T) {
+	model := NewModel(Config{})
+	model.Learn("this is a test")
+	model.Learn("this is another test")
+	model.Learn("there are more tests")
+
+	c, err := model.ReplyCandidate(context.Background(), "test", ReplyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Text != strings.Join(c.Words, " ") || c.Pivot != "test" {
+		t.Errorf("ReplyCandidate(test) => %+v, want its words and pivot", c)
+	}
+
+	// The same seed gets the same reply.
+	reply := func() string {
+		c, err := model.ReplyCandidate(context.Background(), "", ReplyOptions{Rand: rand.NewSource(7)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c.Text
+	}
+
+	want := reply()
+	for i := 0; i < 20; i++ {
+		if got := reply(); got != want {
+			t.Fatalf("ReplyCandidate(seed 7) => %q, want %q", got, want)
+		}
+	}
+
+	empty := NewModel(Config{})
+	if c, err := empty.ReplyCandidate(context.Background(), "test", ReplyOptions{}); c != nil || err != nil {
+		t.Errorf("ReplyCandidate() on an empty model => %v, %v", c, err)
+	}
+}
+
+func TestReplyStream(t *testing.T) {
+	model := NewModel(Config{})
+	model.Learn("this is a test")
+	model.Learn("this is another test")
+	model.Learn("there are more tests")
+
+	for i := 0; i < 20; i++ {
+		var words []string
+		reply, err := model.ReplyStream(context.Background(), "test", func(word string) error {
+			words = append(words, word)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if reply == "" || reply != strings.Join(words, " ") {
+			t.Fatalf("ReplyStream(test) => %q, streamed %q", reply, words)
+		}
+	}
+
+	// An error from the callback stops the reply.
+	stop := errors.New("stop")
+	var n int
+	reply, err := model.ReplyStream(context.Background(), "test", func(word string) error {
+		n++
+		return stop
+	})
+	if err != stop || reply != "" || n != 1 {
+		t.Errorf("ReplyStream(test) with a failing callback => %q, %v after %d words", reply, err, n)
+	}
+
+	empty := NewModel(Config{})
+	if reply, err := empty.ReplyStream(context.Background(), "test", nil); reply != "" || err != nil {
+		t.Errorf("ReplyStream() on an empty model => %q, %v", reply, err)
+	}
+}
+
+func TestLearnable(t *testing.T) {
+	var tests = []struct {
+		text string
+		tok  Tokenizer
+		want bool
+	}{
+		{"this is a test", nil, true},
+		{"single", nil, false},
+		{"  single  ", nil, false},
+		{"", nil, false},
+		{"test.", PunctTokenizer, true},
+		{"漢字", CJKTokenizer, true},
+		{"字", CJKTokenizer, false},
+	}
+
+	for _, tt := range tests {
+		model := NewModel(Config{Tokenizer: tt.tok})
+		if got := model.Learnable(tt.text); got != tt.want {
+			t.Errorf("Learnable(%q) => %v, want %v", tt.text, got, tt.want)
+		}
+	}
+}
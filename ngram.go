@@ -0,0 +1,269 @@
+package fate
+
+// MaxOrder is the highest n-gram order a Model supports.
+const MaxOrder = 5
+
+// ngram is a context of up to MaxOrder-1 tokens. Each context length
+// has its own map, so shorter contexts leave the trailing tokens zero.
+type ngram [MaxOrder - 1]token
+
+// ngrams tracks the tokens seen following and preceding contexts of a
+// single length longer than a bigram. Contexts of length 2 live in
+// trigrams.
+type ngrams [shards]map[ngram]*fwdrev
+
+func (n *ngrams) get(ctx ngram) *fwdrev {
+	return n[ctx.shard()][ctx]
+}
+
+func (n *ngrams) put(ctx ngram, chain *fwdrev) {
+	shard := &n[ctx.shard()]
+	if *shard == nil {
+		*shard = make(map[ngram]*fwdrev)
+	}
+	(*shard)[ctx] = chain
+}
+
+func (n *ngrams) len() int {
+	l := 0
+	for _, shard := range n {
+		l += len(shard)
+	}
+	return l
+}
+
+// each calls fn for every context, in no particular order.
+func (n *ngrams) each(fn func(ctx ngram, chain *fwdrev)) {
+	for _, shard := range n {
+		for ctx, chain := range shard {
+			fn(ctx, chain)
+		}
+	}
+}
+
+// Observe records next following and prev preceding ctx.
+func (n *ngrams) Observe(ctx ngram, prev, next token, counted bool) {
+	chain := n.get(ctx)
+	if chain == nil {
+		chain = &fwdrev{}
+		n.put(ctx, chain)
+	}
+
+	chain.observe(prev, next, counted)
+}
+
+// Forget removes one count of next following and prev preceding ctx,
+// deleting the context when it becomes empty.
+func (n *ngrams) Forget(ctx ngram, prev, next token) {
+	chain := n.get(ctx)
+	if chain == nil {
+		return
+	}
+
+	if chain.forget(prev, next) {
+		delete(n[ctx.shard()], ctx)
+	}
+}
+
+// window is a context of length k, with the tokens seen before and
+// after it.
+type window struct {
+	k          int
+	ctx        ngram
+	prev, next token
+}
+
+// windows returns everything Learn observes for toks, at every context
+// length the model tracks. A context of length k is padded with k+1
+// start and end tokens, so the first context is all start tokens.
+func (m *Model) windows(toks []token) []window {
+	var ret []window
+	for k := 2; k < m.order; k++ {
+		padded := make([]token, 0, len(toks)+2*k+2)
+		for i := 0; i <= k; i++ {
+			padded = append(padded, m.startTok)
+		}
+		padded = append(padded, toks...)
+		for i := 0; i <= k; i++ {
+			padded = append(padded, m.endTok)
+		}
+
+		for i := 0; i+k+1 < len(padded); i++ {
+			w := window{k: k, prev: padded[i], next: padded[i+k+1]}
+			copy(w.ctx[:], padded[i+1:i+k+1])
+			ret = append(ret, w)
+		}
+	}
+
+	return ret
+}
+
+// observeLonger records the contexts longer than a bigram for toks.
+func (m *Model) observeLonger(toks []token) {
+	for _, w := range m.windows(toks) {
+		if w.k > 2 {
+			shard := w.ctx.shard()
+			m.stripes.lock(w.k-1, shard)
+			m.hi[w.k-3].Observe(w.ctx, w.prev, w.next, m.weighted)
+			m.stripes.unlock(w.k-1, shard)
+		}
+	}
+}
+
+// chain returns the successors of a window's context, or nil.
+func (m *Model) chain(w window) *fwdrev {
+	if w.k == 2 {
+		return m.tri.get(bigram{w.ctx[0], w.ctx[1]})
+	}
+
+	return m.hi[w.k-3].get(w.ctx)
+}
+
+// fwdSet returns the tokens seen following the longest known context
+// ending in pos. ext holds the tokens before pos, nearest first, to
+// extend it with. Longer contexts with fewer than the model's backoff
+// successors are skipped.
+func (m *Model) fwdSet(pos bigram, ext []token) tokset {
+	for k := len(ext); k > 0; k-- {
+		var ctx ngram
+		for i := 0; i < k; i++ {
+			ctx[k-1-i] = ext[i]
+		}
+		ctx[k], ctx[k+1] = pos.tok0, pos.tok1
+
+		if fwd, ok := m.chains.context(k+2, ctx, false); ok && fwd.Len() >= m.backoff {
+			return fwd
+		}
+	}
+
+	fwd, _ := m.chains.context(2, ngram{pos.tok0, pos.tok1}, false)
+	return fwd
+}
+
+// revSet returns the tokens seen preceding the longest known context
+// starting with pos. ext holds the tokens after pos, nearest first.
+func (m *Model) revSet(pos bigram, ext []token) tokset {
+	for k := len(ext); k > 0; k-- {
+		var ctx ngram
+		ctx[0], ctx[1] = pos.tok0, pos.tok1
+		copy(ctx[2:], ext[:k])
+
+		if rev, ok := m.chains.context(k+2, ctx, true); ok && rev.Len() >= m.backoff {
+			return rev
+		}
+	}
+
+	rev, _ := m.chains.context(2, ngram{pos.tok0, pos.tok1}, true)
+	return rev
+}
+
+// chains is where a Model's replies find what follows and precedes
+// its contexts.
+type chains interface {
+	// context returns the tokens seen following ctx, a context of
+	// length k, or preceding it if rev is set. It reports false if
+	// ctx hasn't been seen.
+	context(k int, ctx ngram, rev bool) (tokset, bool)
+
+	// nextSet returns the tokens seen following tok.
+	nextSet(tok token) tokset
+
+	// empty reports whether there's nothing to reply with.
+	empty() bool
+
+	// rlock and runlock guard the chains while a reply reads them.
+	rlock()
+	runlock()
+}
+
+// liveChains is the chains of a model that learns: its own maps,
+// guarded by its lock.
+type liveChains Model
+
+func (c *liveChains) context(k int, ctx ngram, rev bool) (tokset, bool) {
+	var chain *fwdrev
+	if k == 2 {
+		chain = c.tri.get(bigram{ctx[0], ctx[1]})
+	} else {
+		chain = c.hi[k-3].get(ctx)
+	}
+
+	if chain == nil {
+		return tokset{}, false
+	}
+
+	return chain.dir(rev), true
+}
+
+func (c *liveChains) nextSet(tok token) tokset {
+	if next := c.bi.get(tok); next != nil {
+		return *next
+	}
+
+	return tokset{}
+}
+
+func (c *liveChains) empty() bool {
+	return c.bi.len() == 0
+}
+
+func (c *liveChains) rlock() {
+	c.lock.RLock()
+}
+
+func (c *liveChains) runlock() {
+	c.lock.RUnlock()
+}
+
+// dir returns the tokens following c's context, or preceding it if
+// rev is set.
+func (c *fwdrev) dir(rev bool) tokset {
+	if rev {
+		return c.rev
+	}
+
+	return c.fwd
+}
+
+// fwdExt returns the tokens usable to extend the context at the end
+// of path, nearest first. Paths begin at the start of a sentence, so
+// they're padded with start tokens.
+func (m *Model) fwdExt(buf []token, path []token) []token {
+	buf = buf[:0]
+	for i := 0; i < len(m.hi); i++ {
+		if j := len(path) - 3 - i; j >= 0 {
+			buf = append(buf, path[j])
+		} else {
+			buf = append(buf, m.startTok)
+		}
+	}
+
+	return buf
+}
+
+// revExt returns the tokens usable to extend the context at the
+// beginning of a reverse walk, nearest first. rev holds the tokens
+// walked so far, in reverse order, from the pivot context fwdctx. If
+// the pivot context ends the sentence, it's padded with end tokens.
+func (m *Model) revExt(buf []token, rev []token, fwdctx bigram) []token {
+	buf = buf[:0]
+	for i := 0; i < len(m.hi); i++ {
+		// j indexes the sentence so far: rev in forward order,
+		// then fwdctx.
+		j := 2 + i
+		switch {
+		case j < len(rev):
+			buf = append(buf, rev[len(rev)-1-j])
+		case j == len(rev):
+			buf = append(buf, fwdctx.tok0)
+		case j == len(rev)+1:
+			buf = append(buf, fwdctx.tok1)
+		case fwdctx.tok1 == m.endTok:
+			buf = append(buf, m.endTok)
+		default:
+			return buf
+		}
+	}
+
+	return buf
+}
@@ -0,0 +1,95 @@
+package fate
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestOrder(t *testing.T) {
+	model := NewModel(Config{Order: 4})
+	model.Learn("one two three four")
+	model.Learn("five two three six")
+
+	for i := 0; i < 1000; i++ {
+		reply := model.Reply("one")
+		if reply != "one two three four" {
+			t.Fatalf("Reply(one) => %s, want %s", reply, "one two three four")
+		}
+
+		reply = model.Reply("six")
+		if reply != "five two three six" {
+			t.Fatalf("Reply(six) => %s, want %s", reply, "five two three six")
+		}
+	}
+
+	// With a backoff of 2, the single successor contexts are too
+	// sparse, and the trigrams make both replies possible.
+	model = NewModel(Config{Order: 4, Backoff: 2})
+	model.Learn("one two three four")
+	model.Learn("five two three six")
+
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		seen[model.Reply("one")] = true
+	}
+
+	if !seen["one two three four"] || !seen["one two three six"] || len(seen) != 2 {
+		t.Errorf("Reply(one) => %v, want both endings", seen)
+	}
+}
+
+func TestOrderForget(t *testing.T) {
+	model := NewModel(Config{Order: 5, Weighted: true})
+	model.Learn("one two three four five")
+
+	want := make([]int, len(model.hi))
+	for i := range model.hi {
+		want[i] = model.hi[i].len()
+	}
+
+	model.Learn("one two three six seven")
+	if err := model.Forget("one two three six seven"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range model.hi {
+		if n := model.hi[i].len(); n != want[i] {
+			t.Errorf("Forget() left %d contexts of length %d, want %d", n, i+3, want[i])
+		}
+	}
+}
+
+func TestWriteReadOrder(t *testing.T) {
+	sentences := corpus(vocab(100), 1000, func() int {
+		return clamp(gauss(10, 5))
+	})
+
+	model := NewModel(Config{Order: 5, Rand: rand.NewSource(1)})
+	for _, sen := range sentences {
+		model.Learn(sen)
+	}
+
+	var buf bytes.Buffer
+	if _, err := model.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := ReadModel(&buf, Config{Rand: rand.NewSource(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if loaded.order != 5 {
+		t.Fatalf("ReadModel() => order %d, want 5", loaded.order)
+	}
+
+	for i := 0; i < 100; i++ {
+		q := sentences[i]
+
+		want, got := model.Reply(q), loaded.Reply(q)
+		if got != want {
+			t.Fatalf("Reply(%q) => %q after load, want %q", q, got, want)
+		}
+	}
+}
@@ -1,15 +1,123 @@
 package fate
 
-type bigrams map[token]*tokset
+import "sync"
 
-func (b bigrams) Observe(tok0 token, tok1 token) {
-	ctx, ok := b[tok0]
-	if !ok {
+// A model's chains are each split across shards maps by a hash of
+// their contexts, so LearnAll's workers can update different parts of
+// them at once.
+const (
+	shardBits = 6
+	shards    = 1 << shardBits
+)
+
+func shardOf(h uint32) int {
+	return int(h >> (32 - shardBits))
+}
+
+func (t token) shard() int {
+	return shardOf(uint32(t) * 0x9e3779b1)
+}
+
+func (b bigram) shard() int {
+	return shardOf((uint32(b.tok0)*0x9e3779b1 ^ uint32(b.tok1)) * 0x85ebca6b)
+}
+
+func (n ngram) shard() int {
+	var h uint32
+	for _, tok := range n {
+		h = (h ^ uint32(tok)) * 0x9e3779b1
+	}
+	return shardOf(h)
+}
+
+// stripes locks the shards of a model's chains while LearnAll's
+// workers are updating them. locks[0] is for the bigrams, locks[1]
+// for the trigrams, and locks[k-1] for contexts of length k. A nil
+// stripes doesn't lock: Learn has the model to itself.
+type stripes struct {
+	locks [MaxOrder - 1][shards]sync.Mutex
+
+	// dict guards the model's dictionary.
+	dict sync.RWMutex
+}
+
+func (s *stripes) lock(level, shard int) {
+	if s != nil {
+		s.locks[level][shard].Lock()
+	}
+}
+
+func (s *stripes) unlock(level, shard int) {
+	if s != nil {
+		s.locks[level][shard].Unlock()
+	}
+}
+
+type bigrams [shards]map[token]*tokset
+
+func (b *bigrams) get(tok token) *tokset {
+	return b[tok.shard()][tok]
+}
+
+func (b *bigrams) put(tok token, t *tokset) {
+	shard := &b[tok.shard()]
+	if *shard == nil {
+		*shard = make(map[token]*tokset)
+	}
+	(*shard)[tok] = t
+}
+
+func (b *bigrams) len() int {
+	n := 0
+	for _, shard := range b {
+		n += len(shard)
+	}
+	return n
+}
+
+// each calls fn for every token followed by something, in no
+// particular order.
+func (b *bigrams) each(fn func(tok token, next *tokset)) {
+	for _, shard := range b {
+		for tok, next := range shard {
+			fn(tok, next)
+		}
+	}
+}
+
+// Observe records the bigram (tok0, tok1). If counted, it also counts
+// how many times the bigram has been seen.
+func (b *bigrams) Observe(tok0 token, tok1 token, counted bool) {
+	ctx := b.get(tok0)
+	if ctx == nil {
 		ctx = &tokset{}
-		b[tok0] = ctx
+		b.put(tok0, ctx)
 		stats.Add("TokenLearned", 1)
 	}
-	ctx.Add(tok1)
+
+	if counted {
+		ctx.Incr(tok1)
+	} else {
+		ctx.Add(tok1)
+	}
+}
+
+// Forget removes one count of the bigram (tok0, tok1), deleting
+// tok0's entry when nothing follows it any more. It reports whether
+// tok0 was deleted.
+func (b *bigrams) Forget(tok0 token, tok1 token) bool {
+	ctx := b.get(tok0)
+	if ctx == nil || !ctx.Decr(tok1) {
+		return false
+	}
+
+	if ctx.Len() > 0 {
+		return false
+	}
+
+	delete(b[tok0.shard()], tok0)
+	stats.Add("TokenLearned", -1)
+	return true
 }
 
 type fwdrev struct {
@@ -17,31 +125,117 @@ type fwdrev struct {
 	rev tokset
 }
 
-type trigrams map[bigram]*fwdrev
+// observe records next following and prev preceding this context. It
+// returns whether next had been seen already.
+func (c *fwdrev) observe(prev, next token, counted bool) bool {
+	if counted {
+		c.rev.Incr(prev)
+		return c.fwd.Incr(next)
+	}
+
+	c.rev.Add(prev)
+	return c.fwd.Add(next)
+}
+
+// forget removes one count of next following and prev preceding this
+// context, returning whether it's now empty.
+func (c *fwdrev) forget(prev, next token) bool {
+	c.fwd.Decr(next)
+	c.rev.Decr(prev)
+	return c.fwd.Len() == 0
+}
+
+type trigrams [shards]map[bigram]*fwdrev
+
+func (t *trigrams) get(ctx bigram) *fwdrev {
+	return t[ctx.shard()][ctx]
+}
+
+func (t *trigrams) put(ctx bigram, chain *fwdrev) {
+	shard := &t[ctx.shard()]
+	if *shard == nil {
+		*shard = make(map[bigram]*fwdrev)
+	}
+	(*shard)[ctx] = chain
+}
+
+func (t *trigrams) len() int {
+	n := 0
+	for _, shard := range t {
+		n += len(shard)
+	}
+	return n
+}
+
+// each calls fn for every context, in no particular order.
+func (t *trigrams) each(fn func(ctx bigram, chain *fwdrev)) {
+	for _, shard := range t {
+		for ctx, chain := range shard {
+			fn(ctx, chain)
+		}
+	}
+}
 
-func (t trigrams) Observe(tok0, tok1, tok2, tok3 token) (had2 bool) {
+// Observe records tok3 following and tok0 preceding the bigram
+// (tok1, tok2). If counted, it also counts how many times each has
+// been seen.
+func (t *trigrams) Observe(tok0, tok1, tok2, tok3 token, counted bool) (had2 bool) {
 	ctx := bigram{tok1, tok2}
 
-	chain, had2 := t[ctx]
+	chain := t.get(ctx)
+	had2 = chain != nil
 	if !had2 {
 		chain = &fwdrev{}
-		t[ctx] = chain
+		t.put(ctx, chain)
 		stats.Add("BigramLearned", 1)
 	}
 
-	if !chain.fwd.Add(tok3) {
+	if !chain.observe(tok0, tok3, counted) {
 		stats.Add("TrigramLearned", 1)
 	}
 
-	chain.rev.Add(tok0)
-
 	return had2
 }
 
-func (t trigrams) Fwd(ctx bigram) *tokset {
-	return &(t[ctx].fwd)
+// Forget removes one count of tok3 following and tok0 preceding the
+// bigram (tok1, tok2), deleting the context when it becomes empty. It
+// reports whether the context was deleted.
+func (t *trigrams) Forget(tok0, tok1, tok2, tok3 token) bool {
+	ctx := bigram{tok1, tok2}
+
+	chain := t.get(ctx)
+	if chain == nil {
+		return false
+	}
+
+	empty := chain.forget(tok0, tok3)
+	if chain.fwd.CountOf(tok3) == 0 {
+		stats.Add("TrigramLearned", -1)
+	}
+
+	if !empty {
+		return false
+	}
+
+	delete(t[ctx.shard()], ctx)
+	stats.Add("BigramLearned", -1)
+	return true
 }
 
-func (t trigrams) Rev(ctx bigram) *tokset {
-	return &(t[ctx].rev)
+// Fwd returns the tokens seen following ctx, or nil if there are none.
+func (t *trigrams) Fwd(ctx bigram) *tokset {
+	chain := t.get(ctx)
+	if chain == nil {
+		return nil
+	}
+	return &chain.fwd
+}
+
+// Rev returns the tokens seen preceding ctx, or nil if there are none.
+func (t *trigrams) Rev(ctx bigram) *tokset {
+	chain := t.get(ctx)
+	if chain == nil {
+		return nil
+	}
+	return &chain.rev
 }
@@ -9,8 +9,8 @@ import (
 )
 
 // These functions automatically balance quotes/parens/etc in strings.
-// Since fate's tokenizer splits only on spaces, replies often contain
-// unmatched quotes or parentheses.
+// Since fate's default tokenizer splits only on spaces, replies often
+// contain unmatched quotes or parentheses.
 
 // QuoteFix automatically balances quotes/parens/etc in text strings.
 func QuoteFix(s string) string {
@@ -0,0 +1,528 @@
+package fate
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"sort"
+)
+
+// Model snapshots start with a magic string and a format version,
+// followed by the model flags and order, the sequence number of the
+// first journal record the snapshot doesn't include, the dictionary,
+// the synonym map, the bigrams, the trigrams and any longer contexts.
+// Integers are uvarints. The snapshot ends with a little-endian CRC-32
+// (IEEE) of everything before it.
+var magic = [4]byte{'f', 'a', 't', 'e'}
+
+const formatVersion = 1
+
+const (
+	flagWeighted = 1 << iota
+)
+
+var (
+	// ErrFormat is returned by ReadModel when its input isn't a
+	// model snapshot, or is a snapshot from an unknown version.
+	ErrFormat = errors.New("fate: unrecognized model format")
+
+	// ErrChecksum is returned by ReadModel when a snapshot is
+	// truncated or corrupt.
+	ErrChecksum = errors.New("fate: model checksum mismatch")
+)
+
+// WriteTo writes a binary snapshot of the model to w. It implements
+// io.WriterTo.
+func (m *Model) WriteTo(w io.Writer) (int64, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	seq := m.journaled
+	if m.journal != nil {
+		seq = m.journal.next()
+	}
+
+	return m.writeTo(w, seq)
+}
+
+// writeTo is WriteTo, for callers holding the model's lock. seq is
+// the sequence number of the first journal record the model hasn't
+// learned.
+func (m *Model) writeTo(w io.Writer, seq uint64) (int64, error) {
+	e := newEncoder(w)
+
+	e.write(magic[:])
+	e.uint32(formatVersion)
+
+	var flags uint64
+	if m.weighted {
+		flags |= flagWeighted
+	}
+	e.uvarint(flags)
+	e.uvarint(uint64(m.order))
+	e.uvarint(seq)
+
+	e.uvarint(uint64(m.tokens.Len()))
+	for _, word := range m.tokens.d.words {
+		e.string(word)
+	}
+
+	stems := make([]string, 0, len(m.tokens.syns))
+	for stem := range m.tokens.syns {
+		stems = append(stems, stem)
+	}
+	sort.Strings(stems)
+
+	e.uvarint(uint64(len(stems)))
+	for _, stem := range stems {
+		e.string(stem)
+		e.tokens(m.tokens.syns[stem].Tokens())
+	}
+
+	bitoks := make([]token, 0, m.bi.len())
+	m.bi.each(func(tok token, _ *tokset) {
+		bitoks = append(bitoks, tok)
+	})
+	sort.Slice(bitoks, func(i, j int) bool { return bitoks[i] < bitoks[j] })
+
+	e.uvarint(uint64(len(bitoks)))
+	for _, tok := range bitoks {
+		e.uvarint(uint64(tok))
+		e.tokset(m.bi.get(tok))
+	}
+
+	ctxs := make([]bigram, 0, m.tri.len())
+	m.tri.each(func(ctx bigram, _ *fwdrev) {
+		ctxs = append(ctxs, ctx)
+	})
+	sort.Slice(ctxs, func(i, j int) bool { return ctxs[i].less(ctxs[j]) })
+
+	e.uvarint(uint64(len(ctxs)))
+	for _, ctx := range ctxs {
+		chain := m.tri.get(ctx)
+		e.uvarint(uint64(ctx.tok0))
+		e.uvarint(uint64(ctx.tok1))
+		e.tokset(&chain.fwd)
+		e.tokset(&chain.rev)
+	}
+
+	for i := range m.hi {
+		hi := &m.hi[i]
+		k := i + 3
+
+		ngs := make([]ngram, 0, hi.len())
+		hi.each(func(ctx ngram, _ *fwdrev) {
+			ngs = append(ngs, ctx)
+		})
+		sort.Slice(ngs, func(i, j int) bool { return ngs[i].less(ngs[j]) })
+
+		e.uvarint(uint64(len(ngs)))
+		for _, ctx := range ngs {
+			chain := hi.get(ctx)
+			for _, tok := range ctx[:k] {
+				e.uvarint(uint64(tok))
+			}
+			e.tokset(&chain.fwd)
+			e.tokset(&chain.rev)
+		}
+	}
+
+	return e.finish()
+}
+
+// ReadModel reads a model snapshot written by Model.WriteTo. The
+// Stemmer and Rand in opts aren't part of the snapshot; pass the same
+// Config used for the original model to get the same replies. Weighted
+// and Order are taken from the snapshot.
+func ReadModel(r io.Reader, opts Config) (*Model, error) {
+	d := newDecoder(r)
+
+	var head [4]byte
+	d.read(head[:])
+	if d.err != nil || head != magic {
+		return nil, ErrFormat
+	}
+
+	if d.uint32() != formatVersion {
+		return nil, ErrFormat
+	}
+
+	flags := d.uvarint()
+	opts.Weighted = flags&flagWeighted != 0
+
+	opts.Order = d.count()
+	if opts.Order < 3 || opts.Order > MaxOrder {
+		return nil, ErrFormat
+	}
+
+	journaled := d.uvarint()
+
+	// Publish the model only once it's been read successfully.
+	name := opts.Expvar
+	opts.Expvar = ""
+
+	m := NewModel(opts)
+	m.journaled = journaled
+
+	tokens := newSyndict(opts.stemmerOrDefault())
+
+	nwords := d.count()
+	for i := 0; i < nwords && d.err == nil; i++ {
+		tokens.d.Append(d.string())
+	}
+
+	nstems := d.count()
+	for i := 0; i < nstems && d.err == nil; i++ {
+		stem := d.string()
+		tokens.syns[stem] = &tokset2{t: d.tokens()}
+	}
+
+	nbi := d.count()
+	for i := 0; i < nbi && d.err == nil; i++ {
+		tok := d.token()
+		m.bi.put(tok, d.tokset())
+	}
+
+	ntri := d.count()
+	for i := 0; i < ntri && d.err == nil; i++ {
+		ctx := bigram{d.token(), d.token()}
+		chain := &fwdrev{}
+		chain.fwd = *d.tokset()
+		chain.rev = *d.tokset()
+		m.tri.put(ctx, chain)
+	}
+
+	for i := range m.hi {
+		hi := &m.hi[i]
+		k := i + 3
+
+		n := d.count()
+		for j := 0; j < n && d.err == nil; j++ {
+			var ctx ngram
+			for t := 0; t < k; t++ {
+				ctx[t] = d.token()
+			}
+
+			chain := &fwdrev{}
+			chain.fwd = *d.tokset()
+			chain.rev = *d.tokset()
+			hi.put(ctx, chain)
+		}
+	}
+
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+
+	if tokens.Len() < 2 {
+		return nil, fmt.Errorf("fate: model has %d tokens, want at least 2", tokens.Len())
+	}
+
+	if !m.inRange(tokens) {
+		return nil, ErrChecksum
+	}
+
+	m.tokens = tokens
+	m.startTok = tokens.ID("<S>")
+	m.endTok = tokens.ID("</S>")
+
+	if name != "" {
+		m.publish(name)
+	}
+
+	return m, nil
+}
+
+// inRange reports whether every token in m's chains and in tokens'
+// synonyms is in tokens, and whether the chains' toksets are valid,
+// as the frozen loader checks its files.
+func (m *Model) inRange(tokens *syndict) bool {
+	n := tokens.Len()
+
+	for _, syns := range tokens.syns {
+		for _, tok := range syns.Tokens() {
+			if int(tok) >= n {
+				return false
+			}
+		}
+	}
+
+	ok := true
+	m.bi.each(func(tok token, next *tokset) {
+		ok = ok && int(tok) < n && next.valid(n)
+	})
+	m.tri.each(func(ctx bigram, chain *fwdrev) {
+		ok = ok && int(ctx.tok0) < n && int(ctx.tok1) < n &&
+			chain.fwd.valid(n) && chain.rev.valid(n)
+	})
+
+	for i := range m.hi {
+		k := i + 3
+		m.hi[i].each(func(ctx ngram, chain *fwdrev) {
+			for _, tok := range ctx[:k] {
+				ok = ok && int(tok) < n
+			}
+			ok = ok && chain.fwd.valid(n) && chain.rev.valid(n)
+		})
+	}
+
+	return ok
+}
+
+func (b bigram) less(o bigram) bool {
+	if b.tok0 != o.tok0 {
+		return b.tok0 < o.tok0
+	}
+	return b.tok1 < o.tok1
+}
+
+func (n ngram) less(o ngram) bool {
+	for i := range n {
+		if n[i] != o[i] {
+			return n[i] < o[i]
+		}
+	}
+	return false
+}
+
+// encoder writes snapshot data, keeping the first error it sees so
+// callers can check once at the end.
+type encoder struct {
+	w   *bufio.Writer
+	crc hash.Hash32
+	n   int64
+	err error
+	tmp [binary.MaxVarintLen64]byte
+}
+
+func newEncoder(w io.Writer) *encoder {
+	crc := crc32.NewIEEE()
+	return &encoder{w: bufio.NewWriter(io.MultiWriter(w, crc)), crc: crc}
+}
+
+func (e *encoder) write(buf []byte) {
+	if e.err != nil {
+		return
+	}
+
+	n, err := e.w.Write(buf)
+	e.n += int64(n)
+	e.err = err
+}
+
+func (e *encoder) uvarint(v uint64) {
+	n := binary.PutUvarint(e.tmp[:], v)
+	e.write(e.tmp[:n])
+}
+
+func (e *encoder) uint32(v uint32) {
+	binary.LittleEndian.PutUint32(e.tmp[:], v)
+	e.write(e.tmp[:4])
+}
+
+func (e *encoder) uint64(v uint64) {
+	binary.LittleEndian.PutUint64(e.tmp[:], v)
+	e.write(e.tmp[:8])
+}
+
+func (e *encoder) string(s string) {
+	e.uvarint(uint64(len(s)))
+	if e.err == nil {
+		n, err := e.w.WriteString(s)
+		e.n += int64(n)
+		e.err = err
+	}
+}
+
+func (e *encoder) tokens(toks []token) {
+	e.uvarint(uint64(len(toks)))
+	for _, tok := range toks {
+		e.uvarint(uint64(tok))
+	}
+}
+
+func (e *encoder) tokset(t *tokset) {
+	e.uvarint(uint64(t.c1))
+	e.uvarint(uint64(t.c2))
+	e.uvarint(uint64(t.c3))
+	if t.counted {
+		e.uvarint(1)
+	} else {
+		e.uvarint(0)
+	}
+	e.uvarint(uint64(len(t.buf)))
+	e.write(t.buf)
+}
+
+func (e *encoder) finish() (int64, error) {
+	if e.err == nil {
+		e.err = e.w.Flush()
+	}
+
+	if e.err != nil {
+		return e.n, e.err
+	}
+
+	// Everything written so far has been flushed through the hash.
+	binary.LittleEndian.PutUint32(e.tmp[:], e.crc.Sum32())
+	e.write(e.tmp[:4])
+	if e.err == nil {
+		e.err = e.w.Flush()
+	}
+
+	return e.n, e.err
+}
+
+// maxChunk bounds the allocations made for a single length read from
+// the input, so corrupt lengths fail on a short read rather than
+// exhausting memory.
+const maxChunk = 1 << 20
+
+// decoder reads snapshot data, keeping the first error it sees.
+type decoder struct {
+	r   *bufio.Reader
+	crc uint32
+	err error
+	one [1]byte
+}
+
+func newDecoder(r io.Reader) *decoder {
+	return &decoder{r: bufio.NewReader(r)}
+}
+
+func (d *decoder) ReadByte() (byte, error) {
+	b, err := d.r.ReadByte()
+	if err == nil {
+		d.one[0] = b
+		d.crc = crc32.Update(d.crc, crc32.IEEETable, d.one[:])
+	}
+	return b, err
+}
+
+func (d *decoder) read(buf []byte) {
+	if d.err != nil {
+		return
+	}
+
+	_, err := io.ReadFull(d.r, buf)
+	if err != nil {
+		d.fail(err)
+		return
+	}
+
+	d.crc = crc32.Update(d.crc, crc32.IEEETable, buf)
+}
+
+func (d *decoder) fail(err error) {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = ErrChecksum
+	}
+	d.err = err
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+
+	v, err := binary.ReadUvarint(d)
+	if err != nil {
+		d.fail(err)
+	}
+	return v
+}
+
+func (d *decoder) uint32() uint32 {
+	var buf [4]byte
+	d.read(buf[:])
+	return binary.LittleEndian.Uint32(buf[:])
+}
+
+func (d *decoder) count() int {
+	v := d.uvarint()
+	if v > 1<<31-1 {
+		d.fail(ErrChecksum)
+		return 0
+	}
+	return int(v)
+}
+
+func (d *decoder) token() token {
+	v := d.uvarint()
+	if v > 0xFFFFFFFF {
+		d.fail(ErrChecksum)
+		return 0
+	}
+	return token(v)
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.count()
+
+	var buf []byte
+	for n > 0 && d.err == nil {
+		chunk := n
+		if chunk > maxChunk {
+			chunk = maxChunk
+		}
+
+		buf = append(buf, make([]byte, chunk)...)
+		d.read(buf[len(buf)-chunk:])
+		n -= chunk
+	}
+
+	return buf
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+func (d *decoder) tokens() []token {
+	n := d.count()
+
+	var toks []token
+	for i := 0; i < n && d.err == nil; i++ {
+		toks = append(toks, d.token())
+	}
+
+	return toks
+}
+
+func (d *decoder) tokset() *tokset {
+	c1, c2, c3, counted := d.uvarint(), d.uvarint(), d.uvarint(), d.uvarint()
+	buf := d.bytes()
+
+	t := &tokset{buf: buf, c1: uint8(c1), c2: uint16(c2), c3: uint32(c3), counted: counted == 1}
+
+	if c1 > 0xFF || c2 > 0xFFFF || c3 > 0xFFFFFF || counted > 1 ||
+		!toksetFits(len(buf), int(c1), int(c2), int(c3), counted == 1) {
+		d.fail(ErrChecksum)
+		return &tokset{}
+	}
+
+	return t
+}
+
+func (d *decoder) finish() error {
+	if d.err != nil {
+		return d.err
+	}
+
+	want := d.crc
+
+	var buf [4]byte
+	if _, err := io.ReadFull(d.r, buf[:]); err != nil {
+		return ErrChecksum
+	}
+
+	if binary.LittleEndian.Uint32(buf[:]) != want {
+		return ErrChecksum
+	}
+
+	return nil
+}
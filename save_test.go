@@ -0,0 +1,182 @@
+package fate
+
+import (
+	"bytes"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestWriteRead(t *testing.T) {
+	sentences := corpus(vocab(1000), 1000, func() int {
+		return clamp(gauss(10, 5))
+	})
+
+	model := NewModel(Config{Rand: rand.NewSource(1)})
+	for _, sen := range sentences {
+		model.Learn(sen)
+	}
+
+	var buf bytes.Buffer
+	n, err := model.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != int64(buf.Len()) {
+		t.Errorf("WriteTo() => %d, wrote %d bytes", n, buf.Len())
+	}
+
+	loaded, err := ReadModel(bytes.NewReader(buf.Bytes()), Config{Rand: rand.NewSource(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		q := sentences[i]
+
+		want, got := model.Reply(q), loaded.Reply(q)
+		if got != want {
+			t.Fatalf("Reply(%q) => %q after load, want %q", q, got, want)
+		}
+	}
+
+	// Writing the loaded model should reproduce the same snapshot.
+	var buf2 bytes.Buffer
+	if _, err := loaded.WriteTo(&buf2); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(buf.Bytes(), buf2.Bytes()) {
+		t.Errorf("WriteTo() after load differs from original snapshot")
+	}
+}
+
+func TestReadCorrupt(t *testing.T) {
+	model := NewModel(Config{})
+	model.Learn("this is a test")
+
+	var buf bytes.Buffer
+	if _, err := model.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	snap := buf.Bytes()
+
+	version := append([]byte(nil), snap...)
+	version[4]++
+
+	// A chain may only use tokens in the dictionary.
+	model.bi.get(model.tokens.ID("this")).Add(token(model.tokens.Len()))
+
+	var bad bytes.Buffer
+	if _, err := model.WriteTo(&bad); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"empty", nil, ErrFormat},
+		{"magic", append([]byte("nope"), snap[4:]...), ErrFormat},
+		{"version", version, ErrFormat},
+		{"truncated", snap[:len(snap)-3], ErrChecksum},
+		{"flipped", flip(snap, len(snap)/2), ErrChecksum},
+		{"tokens", bad.Bytes(), ErrChecksum},
+	}
+
+	for _, tt := range tests {
+		_, err := ReadModel(bytes.NewReader(tt.data), Config{})
+		if err != tt.err {
+			t.Errorf("ReadModel(%s) => %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func flip(buf []byte, pos int) []byte {
+	ret := append([]byte(nil), buf...)
+	ret[pos] ^= 0x01
+	return ret
+}
+
+func BenchmarkReadModel(b *testing.B) {
+	sentences := corpus(vocab(100000), 10000, func() int {
+		return clamp(gauss(10, 5))
+	})
+
+	model := NewModel(Config{})
+	for _, sen := range sentences {
+		model.Learn(sen)
+	}
+
+	var buf bytes.Buffer
+	if _, err := model.WriteTo(&buf); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(buf.Len()))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := ReadModel(bytes.NewReader(buf.Bytes()), Config{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestWriteReadWeighted(t *testing.T) {
+	model := NewModel(Config{Weighted: true, Rand: rand.NewSource(1)})
+	model.Learn("this is a test")
+	model.Learn("this is a test")
+	model.Learn("this is another test")
+
+	var buf bytes.Buffer
+	if _, err := model.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := ReadModel(&buf, Config{Rand: rand.NewSource(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !loaded.weighted {
+		t.Fatalf("ReadModel() lost Weighted")
+	}
+
+	for i := 0; i < 100; i++ {
+		want, got := model.Reply("this"), loaded.Reply("this")
+		if got != want {
+			t.Fatalf("Reply(this) => %q after load, want %q", got, want)
+		}
+	}
+}
+
+func TestWriteReadLargeTokens(t *testing.T) {
+	for _, counted := range []bool{false, true} {
+		ts := tokset{counted: counted}
+		for _, tok := range []token{3, 0xFFFFFFFF, 0xFF + 1, 0xFFFFFF + 1, 0xFFFFFF + 1} {
+			ts.Add(tok)
+		}
+
+		var buf bytes.Buffer
+		e := newEncoder(&buf)
+		e.tokset(&ts)
+		if _, err := e.finish(); err != nil {
+			t.Fatal(err)
+		}
+
+		d := newDecoder(&buf)
+		got := d.tokset()
+		if err := d.finish(); err != nil {
+			t.Fatalf("counted=%v: %v", counted, err)
+		}
+
+		if !reflect.DeepEqual(got, &ts) {
+			t.Errorf("counted=%v: read %v, want %v", counted, got, &ts)
+		}
+	}
+}
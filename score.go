@@ -0,0 +1,236 @@
+package fate
+
+import (
+	"context"
+	"math"
+	"strings"
+	"sync/atomic"
+)
+
+// Candidate is a reply being considered by ReplyBest.
+type Candidate struct {
+	// Text is the reply, and Words the words in it.
+	Text  string
+	Words []string
+
+	// Input holds the words of the text being replied to, and
+	// Pivot the word the reply was generated from.
+	Input []string
+	Pivot string
+
+	// Surprise is the information content of the reply in bits:
+	// the sum of -log2 P(word | context) for each step of the
+	// reply, walked both forward and backward through the model.
+	Surprise float64
+}
+
+// Scorer rates candidate replies. Higher scores are better.
+type Scorer interface {
+	Score(c *Candidate) float64
+}
+
+// ScorerFunc adapts an ordinary function to a Scorer.
+type ScorerFunc func(c *Candidate) float64
+
+// Score returns f(c).
+func (f ScorerFunc) Score(c *Candidate) float64 {
+	return f(c)
+}
+
+// InformationScorer prefers surprising replies, as cobe does. Surprise
+// grows with length, so longer replies are scaled down: by the square
+// root of their length past 8 words, and by their length past 16.
+type InformationScorer struct{}
+
+// Score returns the candidate's Surprise, scaled for length.
+func (InformationScorer) Score(c *Candidate) float64 {
+	info := c.Surprise
+
+	n := float64(len(c.Words))
+	switch {
+	case n > 16:
+		info /= n
+	case n > 8:
+		info /= math.Sqrt(n - 1)
+	}
+
+	return info
+}
+
+// LengthScorer prefers replies close to Target words long.
+type LengthScorer struct {
+	Target int
+}
+
+// Score returns the negated distance from Target, in words.
+func (s LengthScorer) Score(c *Candidate) float64 {
+	return -math.Abs(float64(len(c.Words) - s.Target))
+}
+
+// EchoScorer penalizes replies that repeat the input.
+type EchoScorer struct{}
+
+// Score returns the negated fraction of the reply's words that appear
+// in the input, ignoring case.
+func (EchoScorer) Score(c *Candidate) float64 {
+	if len(c.Words) == 0 {
+		return 0
+	}
+
+	input := make(map[string]bool, len(c.Input))
+	for _, w := range c.Input {
+		input[strings.ToLower(w)] = true
+	}
+
+	var n int
+	for _, w := range c.Words {
+		if input[strings.ToLower(w)] {
+			n++
+		}
+	}
+
+	return -float64(n) / float64(len(c.Words))
+}
+
+// WeightedScorer is a Scorer and its weight within a CombinedScorer.
+type WeightedScorer struct {
+	Scorer Scorer
+	Weight float64
+}
+
+// CombinedScorer sums the scores of several scorers, each multiplied
+// by its weight.
+type CombinedScorer []WeightedScorer
+
+// Score returns the weighted sum of each scorer's score.
+func (cs CombinedScorer) Score(c *Candidate) float64 {
+	var score float64
+	for _, s := range cs {
+		score += s.Weight * s.Scorer.Score(c)
+	}
+	return score
+}
+
+// DefaultScorer prefers surprising replies, with a penalty for
+// repeating the input.
+var DefaultScorer Scorer = CombinedScorer{
+	{InformationScorer{}, 1},
+	{EchoScorer{}, 10},
+}
+
+// ReplyBest generates candidate replies to text and returns the best
+// one according to opts.Scorer. It's ReplyWith without a context; set
+// opts.Candidates or opts.Budget to bound the work.
+func (m *Model) ReplyBest(text string, opts ReplyOptions) (string, error) {
+	return m.ReplyWith(context.Background(), text, opts)
+}
+
+func (m *Model) replyBest(ctx context.Context, text string, opts ReplyOptions) (*Candidate, error) {
+	parent := ctx
+	if opts.Budget > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Budget)
+		defer cancel()
+	}
+
+	scorer := opts.Scorer
+	if scorer == nil {
+		scorer = DefaultScorer
+	}
+
+	words := m.split(text)
+
+	var (
+		best      *Candidate
+		bestScore float64
+		err       error
+	)
+
+	for i := 0; opts.Candidates <= 0 || i < opts.Candidates; i++ {
+		var c *Candidate
+		c, err = m.candidate(ctx, words, opts, true)
+		if c == nil {
+			if err == nil || ctx.Err() != nil {
+				// Empty model, or out of time.
+				break
+			}
+
+			continue
+		}
+
+		if score := scorer.Score(c); best == nil || score > bestScore {
+			best, bestScore = c, score
+		}
+	}
+
+	if parent.Err() != nil {
+		return nil, parent.Err()
+	}
+
+	if best == nil {
+		return nil, err
+	}
+
+	stats.Add("Replied", 1)
+	atomic.AddInt64(&m.count.replied, 1)
+
+	return best, nil
+}
+
+// surprise returns the information content of path, in bits.
+func (m *Model) surprise(path []token) float64 {
+	start, end := m.startTok, m.endTok
+
+	seq := make([]token, 0, len(path)+4)
+	seq = append(seq, start, start)
+	seq = append(seq, path...)
+	seq = append(seq, end, end)
+
+	var (
+		info float64
+		ext  []token
+	)
+
+	// Forward: each token after the two before it, including the
+	// final end token.
+	for i := 2; i < len(seq)-1; i++ {
+		pos := bigram{seq[i-2], seq[i-1]}
+		if len(m.hi) > 0 {
+			ext = m.fwdExt(ext, seq[:i])
+		}
+
+		toks := m.fwdSet(pos, ext)
+		info += bits(&toks, seq[i])
+	}
+
+	// Reverse: each token before the two after it, including the
+	// initial start token.
+	for i := 1; i < len(seq)-2; i++ {
+		pos := bigram{seq[i+1], seq[i+2]}
+		if len(m.hi) > 0 {
+			ext = ext[:0]
+			for j := i + 3; len(ext) < len(m.hi); j++ {
+				if j < len(seq) {
+					ext = append(ext, seq[j])
+				} else {
+					ext = append(ext, end)
+				}
+			}
+		}
+
+		toks := m.revSet(pos, ext)
+		info += bits(&toks, seq[i])
+	}
+
+	return info
+}
+
+// bits returns the information content of choosing tok from toks.
+func bits(toks *tokset, tok token) float64 {
+	n := toks.CountOf(tok)
+	if n == 0 {
+		return 0
+	}
+
+	return -math.Log2(float64(n) / float64(toks.Total()))
+}
@@ -0,0 +1,86 @@
+package fate
+
+import (
+	"context"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplyBest(t *testing.T) {
+	model := NewModel(Config{})
+	model.Learn("this is a test")
+	model.Learn("this is a much longer test of things")
+
+	want := "this is a much longer test of things"
+
+	opts := ReplyOptions{Candidates: 50, Scorer: LengthScorer{Target: 8}}
+	for i := 0; i < 10; i++ {
+		reply, err := model.ReplyBest("this", opts)
+		if err != nil || reply != want {
+			t.Fatalf("ReplyBest(this) => %q, %v, want %q", reply, err, want)
+		}
+	}
+
+	reply, err := model.ReplyBest("this", ReplyOptions{Budget: 10 * time.Millisecond})
+	if err != nil || !strings.HasPrefix(reply, "this is a") {
+		t.Errorf("ReplyBest(this, 10ms) => %q, %v", reply, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = model.ReplyWith(ctx, "this", opts)
+	if err != context.Canceled {
+		t.Errorf("ReplyWith(canceled) => %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestSurprise(t *testing.T) {
+	model := NewModel(Config{Weighted: true})
+	model.Learn("this is a test")
+
+	tokens := model.conflate(strings.Fields("this is a test"))
+
+	// Every step is certain.
+	if s := model.surprise(tokens); s != 0 {
+		t.Errorf("surprise(this is a test) => %v, want 0", s)
+	}
+
+	model.Learn("this is a test")
+	model.Learn("this is another test")
+
+	// "a" follows (this is) 2/3 of the time, and precedes
+	// (test </S>) 2/3 of the time.
+	got := model.surprise(tokens)
+	want := -2 * math.Log2(2.0/3.0)
+	if math.Abs(got-want) > 1e-9 {
+		t.Errorf("surprise(this is a test) => %v, want %v", got, want)
+	}
+}
+
+func TestScorers(t *testing.T) {
+	c := &Candidate{
+		Words:    strings.Fields("this is a test"),
+		Input:    strings.Fields("THIS test"),
+		Surprise: 12,
+	}
+
+	var tests = []struct {
+		name     string
+		scorer   Scorer
+		expected float64
+	}{
+		{"information", InformationScorer{}, 12},
+		{"length", LengthScorer{Target: 6}, -2},
+		{"echo", EchoScorer{}, -0.5},
+		{"combined", CombinedScorer{{InformationScorer{}, 1}, {EchoScorer{}, 10}}, 7},
+	}
+
+	for _, tt := range tests {
+		if score := tt.scorer.Score(c); score != tt.expected {
+			t.Errorf("%s Score() => %v, want %v", tt.name, score, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package fate
+
+import "context"
+
+// maxSearch limits the number of steps taken by a single length
+// constrained search, as a multiple of the model's MaxPath.
+const maxSearch = 100
+
+// search is a depth-first walk from a pivot that keeps the reply
+// within a set of ReplyOptions. Like walk, it finds the start of the
+// sentence before the end, but it can back out of any step that
+// leads past the limits.
+type search struct {
+	m    *Model
+	ctx  context.Context
+	r    intn
+	opts ReplyOptions
+
+	steps int
+	err   error
+
+	// The reply so far: rev is the beginning of the sentence in
+	// reverse order, mid the pivot context and fwd the end.
+	rev, mid, fwd []token
+	fwdctx        bigram
+
+	// The number of words in the reply and their total length,
+	// without spaces.
+	words, size int
+
+	// Scratch space for extending contexts in higher order models.
+	ext []token
+}
+
+func (m *Model) search(ctx context.Context, pivot token, r intn, opts ReplyOptions) ([]token, error) {
+	next := m.chains.nextSet(pivot)
+	if next.Len() == 0 {
+		return nil, m.deadEnd(pivot)
+	}
+
+	s := &search{
+		m:     m,
+		ctx:   ctx,
+		r:     r,
+		opts:  opts,
+		steps: maxSearch * m.maxPath,
+	}
+
+	start, end := m.startTok, m.endTok
+
+	for _, idx := range s.order(&next, end, s.near(1), false) {
+		s.fwdctx = bigram{pivot, next.Index(idx)}
+
+		s.mid = s.mid[:0]
+		s.words, s.size = 0, 0
+
+		// As in walk, the context's tokens are part of the reply
+		// unless they're the start or end.
+		if s.fwdctx.tok0 != start && !s.push(&s.mid, s.fwdctx.tok0) {
+			continue
+		}
+
+		if s.fwdctx.tok1 != end && !s.push(&s.mid, s.fwdctx.tok1) {
+			continue
+		}
+
+		if s.walkrev(s.fwdctx) {
+			return s.path(), nil
+		}
+
+		if s.err != nil {
+			return nil, s.err
+		}
+	}
+
+	return nil, ErrNoFit
+}
+
+// path assembles the reply found by the search.
+func (s *search) path() []token {
+	path := make([]token, 0, s.words)
+	for i := len(s.rev) - 1; i >= 0; i-- {
+		path = append(path, s.rev[i])
+	}
+
+	path = append(path, s.mid...)
+	return append(path, s.fwd...)
+}
+
+// walkrev searches backward from pos to the start of the sentence,
+// then forward from the pivot context to its end.
+func (s *search) walkrev(pos bigram) bool {
+	if !s.step() {
+		return false
+	}
+
+	if len(s.m.hi) > 0 {
+		s.ext = s.m.revExt(s.ext, s.rev, s.fwdctx)
+	}
+
+	toks := s.m.revSet(pos, s.ext)
+	if toks.Len() == 0 {
+		return false
+	}
+
+	// The beginning of the sentence only gets half the budget, so
+	// the end has room.
+	for _, idx := range s.order(&toks, s.m.startTok, s.near(2), false) {
+		tok := toks.Index(idx)
+		if tok == s.m.startTok {
+			if s.fwdctx.tok1 == s.m.endTok {
+				if s.words >= s.opts.MinWords {
+					return true
+				}
+				continue
+			}
+
+			if s.walkfwd(s.fwdctx) {
+				return true
+			}
+		} else if s.push(&s.rev, tok) {
+			if s.walkrev(bigram{tok, pos.tok0}) {
+				return true
+			}
+
+			s.pop(&s.rev)
+		}
+
+		if s.err != nil {
+			return false
+		}
+	}
+
+	return false
+}
+
+// walkfwd searches forward from pos to the end of the sentence.
+func (s *search) walkfwd(pos bigram) bool {
+	if !s.step() {
+		return false
+	}
+
+	if len(s.m.hi) > 0 {
+		s.ext = s.fwdExt()
+	}
+
+	toks := s.m.fwdSet(pos, s.ext)
+	if toks.Len() == 0 {
+		return false
+	}
+
+	short := s.words < s.opts.MinWords
+
+	for _, idx := range s.order(&toks, s.m.endTok, s.near(1), short) {
+		tok := toks.Index(idx)
+		if tok == s.m.endTok {
+			if !short {
+				return true
+			}
+		} else if s.push(&s.fwd, tok) {
+			if s.walkfwd(bigram{pos.tok1, tok}) {
+				return true
+			}
+
+			s.pop(&s.fwd)
+		}
+
+		if s.err != nil {
+			return false
+		}
+	}
+
+	return false
+}
+
+// fwdExt returns the tokens before the last two of the reply so far,
+// nearest first, like Model.fwdExt.
+func (s *search) fwdExt() []token {
+	n := len(s.rev) + len(s.mid) + len(s.fwd)
+
+	ext := s.ext[:0]
+	for i := 0; i < len(s.m.hi); i++ {
+		j := n - 3 - i
+		switch {
+		case j < 0:
+			ext = append(ext, s.m.startTok)
+		case j < len(s.rev):
+			ext = append(ext, s.rev[len(s.rev)-1-j])
+		case j < len(s.rev)+len(s.mid):
+			ext = append(ext, s.mid[j-len(s.rev)])
+		default:
+			ext = append(ext, s.fwd[j-len(s.rev)-len(s.mid)])
+		}
+	}
+
+	return ext
+}
+
+// step accounts for one step of the search, returning false if the
+// search should stop.
+func (s *search) step() bool {
+	if s.err != nil {
+		return false
+	}
+
+	select {
+	case <-s.ctx.Done():
+		s.err = s.ctx.Err()
+		return false
+	default:
+	}
+
+	s.steps--
+	return s.steps >= 0
+}
+
+// push appends tok to *path if the reply stays within its limits.
+func (s *search) push(path *[]token, tok token) bool {
+	words := s.words + 1
+	size := s.size + len(s.m.tokens.Word(tok))
+
+	if words > s.m.maxPath {
+		return false
+	}
+
+	if s.opts.MaxWords > 0 && words > s.opts.MaxWords {
+		return false
+	}
+
+	// Count a space between each word.
+	if s.opts.MaxBytes > 0 && size+words-1 > s.opts.MaxBytes {
+		return false
+	}
+
+	*path = append(*path, tok)
+	s.words, s.size = words, size
+
+	return true
+}
+
+func (s *search) pop(path *[]token) {
+	p := *path
+	tok := p[len(p)-1]
+	*path = p[:len(p)-1]
+
+	s.words--
+	s.size -= len(s.m.tokens.Word(tok))
+}
+
+// near reports whether the reply is within a quarter of 1/div of its
+// limits, where ending the sentence is preferred.
+func (s *search) near(div int) bool {
+	if max := s.opts.MaxWords / div; max > 0 && 4*s.words >= 3*max {
+		return true
+	}
+
+	if max := s.opts.MaxBytes / div; max > 0 && 4*(s.size+s.words) >= 3*max {
+		return true
+	}
+
+	return false
+}
+
+// order returns the indexes of toks in the order the search should
+// try them: a random choice first, then the rest. If prefer is set and
+// goal is present, it goes first; if avoid is set, it goes last.
+func (s *search) order(toks *tokset, goal token, prefer, avoid bool) []int {
+	n := toks.Len()
+	first := toks.choiceIndex(s.r)
+
+	var ret = make([]int, 0, n)
+	for i := 0; i < n; i++ {
+		ret = append(ret, (first+i)%n)
+	}
+
+	if !prefer && !avoid {
+		return ret
+	}
+
+	idx, _, _, ok := toks.find(goal)
+	if !ok {
+		return ret
+	}
+
+	pos := (idx - first + n) % n
+	if prefer {
+		copy(ret[1:pos+1], ret[:pos])
+		ret[0] = idx
+	} else {
+		copy(ret[pos:], ret[pos+1:])
+		ret[n-1] = idx
+	}
+
+	return ret
+}
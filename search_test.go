@@ -0,0 +1,75 @@
+package fate
+
+import (
+	"context"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestReplyWith(t *testing.T) {
+	sentences := corpus(vocab(100), 1000, func() int {
+		return clamp(gauss(10, 5))
+	})
+
+	for _, order := range []int{3, 5} {
+		model := NewModel(Config{Order: order, Rand: rand.NewSource(1)})
+		for _, sen := range sentences {
+			model.Learn(sen)
+		}
+
+		testReplyWith(t, model, sentences)
+	}
+}
+
+func testReplyWith(t *testing.T, model *Model, sentences []string) {
+	var tests = []ReplyOptions{
+		{MaxWords: 5},
+		{MaxBytes: 30},
+		{MinWords: 12},
+		{MinWords: 4, MaxWords: 6},
+	}
+
+	ctx := context.Background()
+
+	for _, opts := range tests {
+		for i := 0; i < 100; i++ {
+			q := sentences[i]
+
+			reply, err := model.ReplyWith(ctx, q, opts)
+			if err != nil {
+				t.Fatalf("[order %d] ReplyWith(%q, %+v) => %v", model.order, q, opts, err)
+			}
+
+			words := len(strings.Fields(reply))
+			if words == 0 ||
+				(opts.MinWords > 0 && words < opts.MinWords) ||
+				(opts.MaxWords > 0 && words > opts.MaxWords) ||
+				(opts.MaxBytes > 0 && len(reply) > opts.MaxBytes) {
+				t.Fatalf("[order %d] ReplyWith(%q, %+v) => %q", model.order, q, opts, reply)
+			}
+		}
+	}
+}
+
+func TestReplyWithNoFit(t *testing.T) {
+	model := NewModel(Config{})
+	model.Learn("foo bar baz")
+
+	ctx := context.Background()
+
+	reply, err := model.ReplyWith(ctx, "foo", ReplyOptions{MaxBytes: 11})
+	if err != nil || reply != "foo bar baz" {
+		t.Errorf("ReplyWith(foo, 11 bytes) => %q, %v, want %q", reply, err, "foo bar baz")
+	}
+
+	_, err = model.ReplyWith(ctx, "foo", ReplyOptions{MaxBytes: 10})
+	if err != ErrNoFit {
+		t.Errorf("ReplyWith(foo, 10 bytes) => %v, want %v", err, ErrNoFit)
+	}
+
+	_, err = model.ReplyWith(ctx, "foo", ReplyOptions{MinWords: 4})
+	if err != ErrNoFit {
+		t.Errorf("ReplyWith(foo, 4 words) => %v, want %v", err, ErrNoFit)
+	}
+}
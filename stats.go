@@ -0,0 +1,179 @@
+package fate
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Stats is a snapshot of a Model's size and activity.
+type Stats struct {
+	// Learned, Forgot and Replied count successful calls to Learn,
+	// Forget and the Reply methods since the Model was created or
+	// read. DeadEnds counts reply walks abandoned at a dead end.
+	Learned  int64
+	Forgot   int64
+	Replied  int64
+	DeadEnds int64
+
+	// Tokens is the number of distinct tokens that something has
+	// been learned following: every learned word, plus the start
+	// and end of sentence markers once anything has been learned.
+	// Bigrams is the number of distinct two-word contexts, and
+	// Trigrams the number of distinct words following them.
+	// Contexts counts the longer contexts of higher order models.
+	Tokens   int
+	Bigrams  int
+	Trigrams int
+	Contexts int
+
+	// MemoryBytes approximates the memory used by the model's
+	// dictionary and chains.
+	MemoryBytes int64
+}
+
+// counters holds a Model's activity counts. They're updated
+// atomically, since replies only hold the read lock.
+type counters struct {
+	learned  int64
+	forgot   int64
+	replied  int64
+	deadEnds int64
+}
+
+// Rough per-entry costs of the Model's maps, including bucket
+// overhead.
+const (
+	mapOverhead = 8
+	toksetSize  = int64(unsafe.Sizeof(tokset{}))
+	fwdrevSize  = int64(unsafe.Sizeof(fwdrev{}))
+	stringSize  = int64(unsafe.Sizeof(""))
+	ngramSize   = int64(unsafe.Sizeof(ngram{}))
+)
+
+// Activity returns the model's activity counts: the Learned, Forgot,
+// Replied and DeadEnds of Stats, with its size fields zero. Unlike
+// Stats, it neither walks the model nor waits for learning.
+func (m *Model) Activity() Stats {
+	return Stats{
+		Learned:  atomic.LoadInt64(&m.count.learned),
+		Forgot:   atomic.LoadInt64(&m.count.forgot),
+		Replied:  atomic.LoadInt64(&m.count.replied),
+		DeadEnds: atomic.LoadInt64(&m.count.deadEnds),
+	}
+}
+
+// Stats returns a snapshot of the model's size and activity.
+func (m *Model) Stats() Stats {
+	s := m.Activity()
+
+	m.chains.rlock()
+	defer m.chains.runlock()
+
+	var mem int64
+
+	if t := m.tokens.table; t != nil {
+		mem += t.size()
+	} else {
+		for _, w := range m.tokens.d.words {
+			mem += stringSize + int64(len(w))
+		}
+		mem += int64(len(m.tokens.d.ids)) * (stringSize + 4 + mapOverhead)
+
+		for _, syns := range m.tokens.syns {
+			mem += stringSize + 8 + mapOverhead + 4*int64(cap(syns.t))
+		}
+	}
+
+	if f, ok := m.chains.(*frozenChains); ok {
+		s.Tokens = f.tokens
+		s.Bigrams = len(f.tri)
+		for i := range f.tri {
+			fwd := f.triChains.get(2 * i)
+			s.Trigrams += fwd.Len()
+		}
+		for _, level := range f.hi {
+			s.Contexts += len(level.ctxs)
+		}
+		s.MemoryBytes = mem + f.size()
+
+		return s
+	}
+
+	s.Tokens = m.bi.len()
+	m.bi.each(func(_ token, next *tokset) {
+		mem += 4 + 8 + mapOverhead + toksetSize + int64(cap(next.buf))
+	})
+
+	s.Bigrams = m.tri.len()
+	m.tri.each(func(_ bigram, chain *fwdrev) {
+		s.Trigrams += chain.fwd.Len()
+		mem += 8 + 8 + mapOverhead + chain.size()
+	})
+
+	for i := range m.hi {
+		s.Contexts += m.hi[i].len()
+		m.hi[i].each(func(_ ngram, chain *fwdrev) {
+			mem += ngramSize + 8 + mapOverhead + chain.size()
+		})
+	}
+
+	s.MemoryBytes = mem
+
+	return s
+}
+
+// size returns the approximate memory used by c.
+func (c *fwdrev) size() int64 {
+	return fwdrevSize + int64(cap(c.fwd.buf)+cap(c.rev.buf))
+}
+
+// statsVar publishes the Stats of a Model with expvar.
+type statsVar struct {
+	lock sync.Mutex
+	m    *Model
+}
+
+func (v *statsVar) String() string {
+	v.lock.Lock()
+	m := v.m
+	v.lock.Unlock()
+
+	buf, err := json.Marshal(m.Stats())
+	if err != nil {
+		return "null"
+	}
+
+	return string(buf)
+}
+
+var (
+	publishLock sync.Mutex
+	published   = make(map[string]*statsVar)
+)
+
+// publish exports m's Stats with expvar under name. expvar can't
+// remove a variable, so publishing a name again (e.g. for a model
+// reloaded from a snapshot) moves it to the newer model.
+func (m *Model) publish(name string) {
+	publishLock.Lock()
+	defer publishLock.Unlock()
+
+	if v, ok := published[name]; ok {
+		v.lock.Lock()
+		v.m = m
+		v.lock.Unlock()
+		return
+	}
+
+	if expvar.Get(name) != nil {
+		panic(fmt.Sprintf("fate: expvar %q is already in use", name))
+	}
+
+	v := &statsVar{m: m}
+	expvar.Publish(name, v)
+	published[name] = v
+}
@@ -0,0 +1,109 @@
+package fate
+
+import (
+	"encoding/json"
+	"expvar"
+	"math/rand"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	model := NewModel(Config{Weighted: true, Rand: rand.NewSource(1)})
+
+	if s := model.Stats(); s != (Stats{MemoryBytes: s.MemoryBytes}) {
+		t.Errorf("Stats() => %+v on an empty model", s)
+	}
+
+	model.Learn("this is a test")
+	model.Learn("this is another test")
+	model.Learn("single")
+
+	for i := 0; i < 3; i++ {
+		model.Reply("this")
+	}
+
+	if err := model.Forget("this is another test"); err != nil {
+		t.Fatal(err)
+	}
+
+	s := model.Stats()
+
+	want := Stats{
+		Learned: 2,
+		Forgot:  1,
+		Replied: 3,
+
+		// <S> this is a test </S>
+		Tokens: 6,
+
+		// <S> <S>, <S> this, ..., test </S>, </S> </S>
+		Bigrams: 7,
+
+		// One word follows each bigram.
+		Trigrams: 7,
+
+		MemoryBytes: s.MemoryBytes,
+	}
+
+	if s != want {
+		t.Errorf("Stats() => %+v, want %+v", s, want)
+	}
+
+	if s.MemoryBytes <= 0 {
+		t.Errorf("Stats().MemoryBytes => %d, want > 0", s.MemoryBytes)
+	}
+
+	if a := model.Activity(); a != (Stats{Learned: 2, Forgot: 1, Replied: 3, DeadEnds: s.DeadEnds}) {
+		t.Errorf("Activity() => %+v, want the counts of %+v", a, s)
+	}
+
+	model.Learn("these are more words to remember")
+	if more := model.Stats().MemoryBytes; more <= s.MemoryBytes {
+		t.Errorf("MemoryBytes didn't grow after Learn: %d -> %d", s.MemoryBytes, more)
+	}
+}
+
+func TestStatsOrder(t *testing.T) {
+	model := NewModel(Config{Order: 4})
+	model.Learn("this is a test")
+
+	// <S> <S> <S>, <S> <S> this, ..., test </S> </S>, </S> </S> </S>
+	if s := model.Stats(); s.Contexts != 8 {
+		t.Errorf("Stats().Contexts => %d, want 8", s.Contexts)
+	}
+}
+
+func TestStatsExpvar(t *testing.T) {
+	name := "fate-test-stats"
+
+	first := NewModel(Config{Expvar: name})
+	first.Learn("this is a test")
+
+	var s Stats
+	if err := json.Unmarshal([]byte(expvar.Get(name).String()), &s); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Learned != 1 {
+		t.Errorf("expvar %s => %+v, want Learned 1", name, s)
+	}
+
+	// Publishing the name again moves it to the new model.
+	NewModel(Config{Expvar: name})
+
+	if err := json.Unmarshal([]byte(expvar.Get(name).String()), &s); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Learned != 0 {
+		t.Errorf("expvar %s => %+v after republishing, want Learned 0", name, s)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("NewModel(Expvar: fate) didn't panic")
+		}
+	}()
+
+	NewModel(Config{Expvar: "fate"})
+}
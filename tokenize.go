@@ -0,0 +1,214 @@
+package fate
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Tokenizer splits text into the words a Model learns and replies
+// with.
+type Tokenizer interface {
+	Tokenize(text string) []string
+}
+
+// Detokenizer joins words generated by a Model back into text. It
+// should undo its Tokenizer.
+type Detokenizer interface {
+	Detokenize(words []string) string
+}
+
+var (
+	// WhitespaceTokenizer splits text on whitespace and joins words
+	// with single spaces. Punctuation stays attached to the words
+	// around it. This is the default.
+	WhitespaceTokenizer = whitespace{}
+
+	// PunctTokenizer splits punctuation at the beginning and end of
+	// words into words of its own, so "test." and "test" are the
+	// same word followed by different things. Its Detokenize
+	// reattaches punctuation to the neighboring words.
+	PunctTokenizer = punct{}
+
+	// CJKTokenizer splits Chinese and Japanese text into single
+	// characters, since those scripts don't separate words with
+	// spaces. Other text is split on whitespace. Its Detokenize
+	// only puts spaces between words outside those scripts.
+	CJKTokenizer = cjk{}
+)
+
+type whitespace struct{}
+
+func (whitespace) Tokenize(text string) []string {
+	var ret []string
+
+	iter := newWords(text)
+	for iter.Next() {
+		ret = append(ret, iter.Word())
+	}
+
+	return ret
+}
+
+func (whitespace) Detokenize(words []string) string {
+	return strings.Join(words, " ")
+}
+
+type punct struct{}
+
+func (punct) Tokenize(text string) []string {
+	var ret []string
+
+	iter := newWords(text)
+	for iter.Next() {
+		word := iter.Word()
+
+		// Words that are all punctuation, like "--" or ":)",
+		// stay whole.
+		if strings.IndexFunc(word, isNotPunct) < 0 {
+			ret = append(ret, word)
+			continue
+		}
+
+		// Leading punctuation splits into single runes, so "(("
+		// can be closed in any combination.
+		for {
+			r, size := utf8.DecodeRuneInString(word)
+			if !unicode.IsPunct(r) {
+				break
+			}
+			ret = append(ret, word[:size])
+			word = word[size:]
+		}
+
+		// Trailing punctuation like "..." or "?!" stays together.
+		end := strings.LastIndexFunc(word, isNotPunct)
+		_, size := utf8.DecodeRuneInString(word[end:])
+		end += size
+
+		ret = append(ret, word[:end])
+		if end < len(word) {
+			ret = append(ret, word[end:])
+		}
+	}
+
+	return ret
+}
+
+func (punct) Detokenize(words []string) string {
+	var buf strings.Builder
+
+	// Straight quotes open and close alternately.
+	var quotes int
+
+	glue := true
+	for _, w := range words {
+		opener := isOpener(w)
+		closer := !opener && isCloser(w)
+
+		if w == `"` || w == "'" {
+			quotes++
+			opener, closer = quotes%2 == 1, quotes%2 == 0
+		}
+
+		if !glue && !closer {
+			buf.WriteByte(' ')
+		}
+
+		buf.WriteString(w)
+		glue = opener
+	}
+
+	return buf.String()
+}
+
+func isNotPunct(r rune) bool {
+	return !unicode.IsPunct(r)
+}
+
+// isOpener reports whether w is a single rune of punctuation that
+// attaches to the beginning of the word after it.
+func isOpener(w string) bool {
+	r, size := utf8.DecodeRuneInString(w)
+	return size == len(w) && (unicode.In(r, unicode.Ps, unicode.Pi) || strings.ContainsRune("¿¡#@", r))
+}
+
+// isCloser reports whether w is made entirely of punctuation that
+// attaches to the end of the word before it.
+func isCloser(w string) bool {
+	if w == "" {
+		return false
+	}
+
+	for _, r := range w {
+		if !unicode.In(r, unicode.Pe, unicode.Pf) && !strings.ContainsRune(`.,;:!?…%"'`, r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+type cjk struct{}
+
+func (cjk) Tokenize(text string) []string {
+	var ret []string
+
+	iter := newWords(text)
+	for iter.Next() {
+		word := iter.Word()
+
+		start := 0
+		for i, r := range word {
+			if !isCJK(r) {
+				continue
+			}
+
+			if start < i {
+				ret = append(ret, word[start:i])
+			}
+
+			size := utf8.RuneLen(r)
+			ret = append(ret, word[i:i+size])
+			start = i + size
+		}
+
+		if start < len(word) {
+			ret = append(ret, word[start:])
+		}
+	}
+
+	return ret
+}
+
+func (cjk) Detokenize(words []string) string {
+	var buf strings.Builder
+
+	prevCJK := true
+	for _, w := range words {
+		r, _ := utf8.DecodeRuneInString(w)
+		wordCJK := isCJK(r)
+
+		if !prevCJK && !wordCJK {
+			buf.WriteByte(' ')
+		}
+
+		buf.WriteString(w)
+		prevCJK = wordCJK
+	}
+
+	return buf.String()
+}
+
+// cjkPunct holds the punctuation used in CJK text, which takes the
+// place of spaces and is treated like the characters around it.
+var cjkPunct = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{Lo: 0x3000, Hi: 0x303f, Stride: 1}, // CJK symbols and punctuation
+		{Lo: 0xff01, Hi: 0xff60, Stride: 1}, // fullwidth forms
+	},
+}
+
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, cjkPunct)
+}
@@ -0,0 +1,58 @@
+package fate
+
+import "testing"
+
+func TestTokenizers(t *testing.T) {
+	var tests = []struct {
+		name     string
+		tok      Tokenizer
+		str      string
+		expected []string
+		joined   string
+	}{
+		{"whitespace", WhitespaceTokenizer, "  this is  a test. ", []string{"this", "is", "a", "test."}, "this is a test."},
+		{"punct", PunctTokenizer, "this is a test.", []string{"this", "is", "a", "test", "."}, "this is a test."},
+		{"punct", PunctTokenizer, `he said "(hello, world)?!"`,
+			[]string{"he", "said", `"`, "(", "hello", ",", "world", `)?!"`}, `he said "(hello, world)?!"`},
+		{"punct", PunctTokenizer, "don't #panic :)", []string{"don't", "#", "panic", ":)"}, "don't #panic:)"},
+		{"cjk", CJKTokenizer, "我喜欢猫。", []string{"我", "喜", "欢", "猫", "。"}, "我喜欢猫。"},
+		{"cjk", CJKTokenizer, "hello 世界 world", []string{"hello", "世", "界", "world"}, "hello世界world"},
+	}
+
+	for _, tt := range tests {
+		words := tt.tok.Tokenize(tt.str)
+		if !StrsEqual(words, tt.expected) {
+			t.Errorf("%s Tokenize(%q) -> %q, expected %q", tt.name, tt.str, words, tt.expected)
+		}
+
+		joined := tt.tok.(Detokenizer).Detokenize(words)
+		if joined != tt.joined {
+			t.Errorf("%s Detokenize(%q) -> %q, expected %q", tt.name, words, joined, tt.joined)
+		}
+	}
+}
+
+func TestModelTokenizer(t *testing.T) {
+	model := NewModel(Config{Tokenizer: PunctTokenizer})
+	model.Learn("this is a test.")
+
+	// "test" is a word of its own, not "test.".
+	for _, q := range []string{"test", "test!"} {
+		if reply := model.Reply(q); reply != "this is a test." {
+			t.Errorf("Reply(%s) => %s, want %s", q, reply, "this is a test.")
+		}
+	}
+
+	model = NewModel(Config{Tokenizer: CJKTokenizer})
+	model.Learn("我喜欢猫")
+
+	if reply := model.Reply("猫"); reply != "我喜欢猫" {
+		t.Errorf("Reply(猫) => %s, want %s", reply, "我喜欢猫")
+	}
+
+	// A single word isn't learnable, but a single CJK word can be
+	// several tokens.
+	if _, ok := model.tokens.CheckID("欢"); !ok {
+		t.Errorf("Learn(我喜欢猫) didn't learn 欢")
+	}
+}
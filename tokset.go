@@ -1,27 +1,232 @@
 package fate
 
-import "sort"
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+)
 
 // tokset maintains a set of tokens as a sorted slice of integers.
 //
 // 1-byte tokens (<= 0xFF) are in buf[0:c1]
 // 2-byte tokens (<= 0xFFFF) are in buf[c1:c1+2*c2]
-// 3-byte tokens (<= 0xFFFFFF) are in buf[c1+2*c2:]
+// 3-byte tokens (<= 0xFFFFFF) are in buf[c1+2*c2:c1+2*c2+3*c3]
+// 4-byte tokens are in buf[c1+2*c2+3*c3:c1+2*c2+3*c3+4*c4]
 //
-// They're stored little-endian. Adds are O(log N). Choosing a random
-// token in the set is O(1).
+// They're stored little-endian. Finding a token is O(log N), and
+// choosing a random token in the set is O(1). Adding a token shifts
+// everything after it, so adds are O(N).
 //
-// tokens greater than 0xFFFFFF are not currently supported. This is
-// enough token space to handle the Web 1T corpus.
+// There's no room in the struct for c4 without growing every tokset,
+// so it's computed from the length of buf. Sets of smaller tokens
+// don't pay for 4-byte token support.
+//
+// A counted tokset also records how many times each token was added.
+// The counts follow the tokens in buf as little-endian uint32s, one per
+// token in the same order, and are kept cumulative so a weighted
+// choice is a binary search: O(log N). Uniform sets don't pay for
+// them. Counting a token rewrites every count after it, so Incr is
+// O(N) even when the token is already present: growing a large
+// weighted successor set one observation at a time is quadratic.
 type tokset struct {
 	buf []byte
 
-	// count of 2-byte tokens, count of 1-byte tokens
+	// count of 3-byte tokens, count of 2-byte tokens, count of
+	// 1-byte tokens
+	c3 uint32
 	c2 uint16
 	c1 uint8
+
+	counted bool
 }
 
+// Add inserts tok into the set, returning whether it was already
+// present. Adding to a counted set increments tok's count.
 func (t *tokset) Add(tok token) bool {
+	if t.counted {
+		return t.Incr(tok)
+	}
+
+	_, had := t.insert(tok)
+	return had
+}
+
+// Incr increments the count for tok, adding it if necessary and
+// returning whether it was already present. An empty set becomes
+// counted on its first Incr; a set with uniform tokens can't be.
+func (t *tokset) Incr(tok token) bool {
+	return t.IncrBy(tok, 1)
+}
+
+// IncrBy adds n to the count for tok, as n calls to Incr would. n
+// must be positive, and the set's total must stay within a uint32.
+func (t *tokset) IncrBy(tok token, n int) bool {
+	if len(t.buf) == 0 {
+		t.counted = true
+	}
+
+	if !t.counted {
+		panic("tokset: Incr on uniform set")
+	}
+
+	if n < 1 || uint64(t.Total())+uint64(n) > math.MaxUint32 {
+		panic("tokset: IncrBy overflows")
+	}
+
+	idx, had := t.insert(tok)
+
+	counts := t.counts()
+	for i := 4 * idx; i < len(counts); i += 4 {
+		putcount(counts[i:], unpackcount(counts[i:])+uint32(n))
+	}
+
+	return had
+}
+
+// countedTokset returns a counted set of toks, which must be
+// increasing, where counts[i] is the count of toks[i]. Building it at
+// once is O(N); adding the tokens one at a time is O(N²).
+func countedTokset(toks []token, counts []int) tokset {
+	t := packTokens(toks, 8*len(toks))
+	t.counted = true
+
+	var total uint32
+	for _, n := range counts {
+		total += uint32(n)
+		t.buf = append(t.buf, byte(total), byte(total>>8), byte(total>>16), byte(total>>24))
+	}
+
+	return t
+}
+
+// uncountedTokset returns an uncounted set of toks, which must be
+// increasing.
+func uncountedTokset(toks []token) tokset {
+	return packTokens(toks, 4*len(toks))
+}
+
+// packTokens returns an uncounted set of toks, which must be
+// increasing, with room for size bytes.
+func packTokens(toks []token, size int) tokset {
+	var t tokset
+
+	buf := make([]byte, 0, size)
+	for _, tok := range toks {
+		switch {
+		case tok <= 0xFF:
+			buf = append(buf, byte(tok))
+			t.c1++
+		case tok <= 0xFFFF:
+			buf = append(buf, byte(tok), byte(tok>>8))
+			t.c2++
+		case tok <= 0xFFFFFF:
+			buf = append(buf, byte(tok), byte(tok>>8), byte(tok>>16))
+			t.c3++
+		default:
+			buf = append(buf, byte(tok), byte(tok>>8), byte(tok>>16), byte(tok>>24))
+		}
+	}
+
+	t.buf = buf
+	return t
+}
+
+// Decr decrements the count for tok in a counted set, removing it
+// when the count reaches zero. It returns false if tok isn't present.
+func (t *tokset) Decr(tok token) bool {
+	idx, loc, width, ok := t.find(tok)
+	if !ok {
+		return false
+	}
+
+	counts := t.counts()
+	for i := 4 * idx; i < len(counts); i += 4 {
+		putcount(counts[i:], unpackcount(counts[i:])-1)
+	}
+
+	if t.Count(idx) == 0 {
+		t.remove(idx, loc, width)
+	}
+
+	return true
+}
+
+// CountOf returns the number of times tok was added, or zero if it
+// isn't present.
+func (t *tokset) CountOf(tok token) int {
+	if t == nil {
+		return 0
+	}
+
+	idx, _, _, ok := t.find(tok)
+	if !ok {
+		return 0
+	}
+
+	return t.Count(idx)
+}
+
+// find locates tok, returning its index, byte offset and width in buf.
+func (t *tokset) find(tok token) (idx, loc, width int, ok bool) {
+	switch {
+	case tok <= 0xFF:
+		span := t.span1()
+		idx = sort.Search(len(span), func(i int) bool {
+			return token(span[i]) >= tok
+		})
+		return idx, idx, 1, idx < len(span) && token(span[idx]) == tok
+	case tok <= 0xFFFF:
+		span := t.span2()
+		i := sort.Search(len(span)/2, func(i int) bool {
+			return unpack2(span[2*i:]) >= tok
+		})
+		ok = i < len(span)/2 && unpack2(span[2*i:]) == tok
+		return int(t.c1) + i, int(t.c1) + 2*i, 2, ok
+	case tok <= 0xFFFFFF:
+		span := t.span3()
+		i := sort.Search(len(span)/3, func(i int) bool {
+			return unpack3(span[3*i:]) >= tok
+		})
+		ok = i < len(span)/3 && unpack3(span[3*i:]) == tok
+		return int(t.c1) + int(t.c2) + i, int(t.c1) + 2*int(t.c2) + 3*i, 3, ok
+	default:
+		span := t.span4()
+		i := sort.Search(len(span)/4, func(i int) bool {
+			return unpack4(span[4*i:]) >= tok
+		})
+		ok = i < len(span)/4 && unpack4(span[4*i:]) == tok
+		return int(t.c1) + int(t.c2) + int(t.c3) + i, t.size3() + 4*i, 4, ok
+	}
+}
+
+// remove deletes the token of the given width at index idx and byte
+// offset loc, along with its count. This is the inverse of grow.
+func (t *tokset) remove(idx, loc, width int) {
+	size := t.size()
+	end := len(t.buf)
+
+	copy(t.buf[loc:], t.buf[loc+width:size])
+
+	if t.counted {
+		cloc := size + 4*idx
+		copy(t.buf[size-width:], t.buf[size:cloc])
+		copy(t.buf[cloc-width:], t.buf[cloc+4:end])
+		end -= 4
+	}
+
+	t.buf = t.buf[:end-width]
+
+	switch width {
+	case 1:
+		t.c1--
+	case 2:
+		t.c2--
+	case 3:
+		t.c3--
+	}
+}
+
+func (t *tokset) insert(tok token) (int, bool) {
 	switch {
 	case tok <= 0xFF:
 		return t.add1(tok)
@@ -31,7 +236,7 @@ func (t *tokset) Add(tok token) bool {
 		return t.add3(tok)
 	}
 
-	panic("oops")
+	return t.add4(tok)
 }
 
 func (t *tokset) span1() []byte {
@@ -43,82 +248,144 @@ func (t *tokset) span2() []byte {
 }
 
 func (t *tokset) span3() []byte {
-	return t.buf[int(t.c1)+2*int(t.c2):]
+	return t.buf[int(t.c1)+2*int(t.c2) : t.size3()]
 }
 
-func (t *tokset) add1(tok token) bool {
-	if len(t.buf) == 0 {
-		t.buf = append(t.buf, byte(tok))
-		t.c1++
-		return false
+func (t *tokset) span4() []byte {
+	return t.buf[t.size3():t.size()]
+}
+
+// size3 returns the number of bytes used by tokens up to 3 bytes.
+func (t *tokset) size3() int {
+	return int(t.c1) + 2*int(t.c2) + 3*int(t.c3)
+}
+
+// size returns the number of bytes used by tokens, not counts.
+func (t *tokset) size() int {
+	return t.size3() + 4*t.c4()
+}
+
+// c4 returns the count of 4-byte tokens: whatever's left in buf after
+// the smaller tokens and the counts.
+func (t *tokset) c4() int {
+	rest := len(t.buf) - t.size3()
+	if !t.counted {
+		return rest / 4
+	}
+
+	// Each 4-byte token has a 4-byte count.
+	return (rest - 4*(int(t.c1)+int(t.c2)+int(t.c3))) / 8
+}
+
+// counts returns the cumulative counts of a counted set.
+func (t *tokset) counts() []byte {
+	return t.buf[t.size():]
+}
+
+// grow makes room for n bytes at loc, and for a count of a new token
+// at index idx if the set is counted. The count inherits the
+// cumulative total before it, so the new token starts at zero.
+func (t *tokset) grow(loc, n, idx int) {
+	size := t.size()
+
+	if !t.counted {
+		t.buf = append(t.buf, make([]byte, n)...)
+		copy(t.buf[loc+n:], t.buf[loc:size])
+		return
 	}
 
+	var prev uint32
+	if idx > 0 {
+		prev = unpackcount(t.buf[size+4*(idx-1):])
+	}
+
+	t.buf = append(t.buf, make([]byte, n+4)...)
+
+	// Shift the counts after idx, then the counts before it, then
+	// the tokens after loc.
+	cloc := size + 4*idx
+	copy(t.buf[cloc+n+4:], t.buf[cloc:size+4*t.Len()])
+	copy(t.buf[size+n:], t.buf[size:cloc])
+	copy(t.buf[loc+n:], t.buf[loc:size])
+
+	putcount(t.buf[cloc+n:], prev)
+}
+
+func (t *tokset) add1(tok token) (int, bool) {
 	span := t.span1()
 	loc := sort.Search(len(span), func(i int) bool {
 		return token(span[i]) >= tok
 	})
 
 	if loc < len(span) && token(span[loc]) == tok {
-		return true
+		return loc, true
 	}
 
-	t.buf = append(t.buf, 0)
-	copy(t.buf[loc+1:], t.buf[loc:])
+	t.grow(loc, 1, loc)
 	t.buf[loc] = byte(tok)
 
 	t.c1++
 
-	return false
+	return loc, false
 }
 
-func (t *tokset) add2(tok token) bool {
-	if len(t.buf) == 0 {
-		t.buf = append(t.buf, byte(tok), byte(tok>>8))
-		t.c2++
-		return false
-	}
-
+func (t *tokset) add2(tok token) (int, bool) {
 	span := t.span2()
 	idx := sort.Search(len(span)/2, func(i int) bool {
 		return unpack2(span[2*i:]) >= tok
 	})
 
 	if idx < len(span)/2 && unpack2(span[2*idx:]) == tok {
-		return true
+		return int(t.c1) + idx, true
 	}
 
-	t.buf = append(t.buf, 0, 0)
-
 	loc := int(t.c1) + 2*idx
-	copy(t.buf[loc+2:], t.buf[loc:])
+	t.grow(loc, 2, int(t.c1)+idx)
 	put2(t.buf[loc:], tok)
 
 	t.c2++
 
-	return false
+	return int(t.c1) + idx, false
 }
-func (t *tokset) add3(tok token) bool {
-	if len(t.buf) == 0 {
-		t.buf = append(t.buf, byte(tok), byte(tok>>8), byte(tok>>16))
-		return false
-	}
 
+func (t *tokset) add3(tok token) (int, bool) {
 	span := t.span3()
 	idx := sort.Search(len(span)/3, func(i int) bool {
 		return unpack3(span[3*i:]) >= tok
 	})
 
+	base := int(t.c1) + int(t.c2)
 	if idx < len(span)/3 && unpack3(span[3*idx:]) == tok {
-		return true
+		return base + idx, true
 	}
 
-	t.buf = append(t.buf, 0, 0, 0)
-
 	loc := int(t.c1) + 2*int(t.c2) + 3*idx
-	copy(t.buf[loc+3:], t.buf[loc:])
+	t.grow(loc, 3, base+idx)
 	put3(t.buf[loc:], tok)
 
-	return false
+	t.c3++
+
+	return base + idx, false
+}
+
+func (t *tokset) add4(tok token) (int, bool) {
+	span := t.span4()
+	idx := sort.Search(len(span)/4, func(i int) bool {
+		return unpack4(span[4*i:]) >= tok
+	})
+
+	base := int(t.c1) + int(t.c2) + int(t.c3)
+	if idx < len(span)/4 && unpack4(span[4*idx:]) == tok {
+		return base + idx, true
+	}
+
+	// c4 follows from the length of buf, so there's nothing to
+	// count here.
+	loc := t.size3() + 4*idx
+	t.grow(loc, 4, base+idx)
+	put4(t.buf[loc:], tok)
+
+	return base + idx, false
 }
 
 func (t *tokset) Len() int {
@@ -126,7 +393,37 @@ func (t *tokset) Len() int {
 		return 0
 	}
 
-	return int(t.c1) + int(t.c2) + len(t.span3())/3
+	return int(t.c1) + int(t.c2) + int(t.c3) + t.c4()
+}
+
+// Total returns the sum of the counts in the set. For uniform sets,
+// each token counts once.
+func (t *tokset) Total() int {
+	if t == nil || !t.counted {
+		return t.Len()
+	}
+
+	n := t.Len()
+	if n == 0 {
+		return 0
+	}
+
+	return int(unpackcount(t.counts()[4*(n-1):]))
+}
+
+// Count returns the number of times the token at index n was added.
+func (t *tokset) Count(n int) int {
+	if !t.counted {
+		return 1
+	}
+
+	counts := t.counts()
+	c := unpackcount(counts[4*n:])
+	if n > 0 {
+		c -= unpackcount(counts[4*(n-1):])
+	}
+
+	return int(c)
 }
 
 func (t *tokset) Tokens() []token {
@@ -149,6 +446,11 @@ func (t *tokset) Tokens() []token {
 		tokens = append(tokens, unpack3(span3[i:]))
 	}
 
+	span4 := t.span4()
+	for i := 0; i < len(span4); i += 4 {
+		tokens = append(tokens, unpack4(span4[i:]))
+	}
+
 	return tokens
 }
 
@@ -163,6 +465,14 @@ func put3(buf []byte, tok token) {
 	buf[2] = byte(tok >> 16)
 }
 
+func put4(buf []byte, tok token) {
+	binary.LittleEndian.PutUint32(buf, uint32(tok))
+}
+
+func putcount(buf []byte, c uint32) {
+	binary.LittleEndian.PutUint32(buf, c)
+}
+
 func unpack2(buf []byte) token {
 	return token(buf[0]) | token(buf[1])<<8
 }
@@ -171,6 +481,14 @@ func unpack3(buf []byte) token {
 	return token(buf[0]) | token(buf[1])<<8 | token(buf[2])<<16
 }
 
+func unpack4(buf []byte) token {
+	return token(binary.LittleEndian.Uint32(buf))
+}
+
+func unpackcount(buf []byte) uint32 {
+	return binary.LittleEndian.Uint32(buf)
+}
+
 func (t tokset) Index(n int) token {
 	switch {
 	case n < int(t.c1):
@@ -178,16 +496,35 @@ func (t tokset) Index(n int) token {
 	case n < int(t.c1)+int(t.c2):
 		span := t.span2()
 		return unpack2(span[2*(n-int(t.c1)):])
-	case n < t.Len():
+	case n < int(t.c1)+int(t.c2)+int(t.c3):
 		span := t.span3()
 		return unpack3(span[3*(n-(int(t.c2)+int(t.c1))):])
+	case n < t.Len():
+		span := t.span4()
+		return unpack4(span[4*(n-(int(t.c3)+int(t.c2)+int(t.c1))):])
 	}
 
 	panic("oops")
 }
 
+// Choice returns a random token from the set. Counted sets choose in
+// proportion to each token's count.
 func (t tokset) Choice(r intn) token {
-	return t.Index(r.Intn(t.Len()))
+	return t.Index(t.choiceIndex(r))
+}
+
+// choiceIndex returns the index of a random token from the set.
+func (t tokset) choiceIndex(r intn) int {
+	if !t.counted {
+		return r.Intn(t.Len())
+	}
+
+	// Find the first token whose cumulative count exceeds x.
+	x := uint32(r.Intn(t.Total()))
+	counts := t.counts()
+	return sort.Search(t.Len(), func(i int) bool {
+		return unpackcount(counts[4*i:]) > x
+	})
 }
 
 // tokset2 stores constant width tokens in a sorted slice.
@@ -221,6 +558,14 @@ func (t *tokset2) Add(tok token) bool {
 	return false
 }
 
+// Remove deletes tok from this set, if present.
+func (t *tokset2) Remove(tok token) {
+	loc := sort.Search(len(t.t), func(i int) bool { return t.t[i] >= tok })
+	if loc < len(t.t) && t.t[loc] == tok {
+		t.t = append(t.t[:loc], t.t[loc+1:]...)
+	}
+}
+
 func (t *tokset2) Tokens() []token {
 	if t == nil {
 		return nil
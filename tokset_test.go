@@ -1,9 +1,12 @@
 package fate
 
 import (
+	"fmt"
+	"math"
 	"math/rand"
 	"reflect"
 	"testing"
+	"unsafe"
 )
 
 func TestAdd(t *testing.T) {
@@ -34,6 +37,8 @@ func TestAddLarger(t *testing.T) {
 	}{
 		{[]token{0, 1, 0xFF, 0xFF + 1, 0xFFFF, 0xFFFF + 1, 0xFFFFFF},
 			toks(0, 1, 0xFF, 0xFF+1, 0xFFFF, 0xFFFF+1, 0xFFFFFF)},
+		{[]token{0xFFFFFFFF, 0xFFFFFF + 1, 2, 0xFFFFFF + 1, 0xFFFF + 1},
+			toks(2, 0xFFFF+1, 0xFFFFFF+1, 0xFFFFFFFF)},
 	}
 
 	for _, tt := range tests {
@@ -58,3 +63,193 @@ func BenchmarkToksetAdd(b *testing.B) {
 		ts.Add(token(rnd.Intn(100000)))
 	}
 }
+
+func TestIncr(t *testing.T) {
+	var ts tokset
+
+	adds := []token{0xFFFF + 1, 7, 0xFF + 1, 0xFFFFFF + 1, 7, 0xFFFFFF, 7, 0xFF + 1, 0xFFFFFF + 1}
+	for _, tok := range adds {
+		ts.Incr(tok)
+	}
+
+	expected := []token{7, 0xFF + 1, 0xFFFF + 1, 0xFFFFFF, 0xFFFFFF + 1}
+	if !reflect.DeepEqual(ts.Tokens(), expected) {
+		t.Fatalf("Incr(%v) -> %v, expected %v", adds, ts.Tokens(), expected)
+	}
+
+	counts := []int{3, 2, 1, 1, 2}
+	for i, want := range counts {
+		if got := ts.Count(i); got != want {
+			t.Errorf("Count(%d) -> %d, expected %d", i, got, want)
+		}
+	}
+
+	if ts.Total() != len(adds) {
+		t.Errorf("Total() -> %d, expected %d", ts.Total(), len(adds))
+	}
+}
+
+func TestIncrBy(t *testing.T) {
+	var ts tokset
+	ts.IncrBy(0xFFFF+1, 5)
+	ts.Incr(7)
+	ts.IncrBy(7, 2)
+
+	if got := ts.CountOf(7); got != 3 {
+		t.Errorf("CountOf(7) -> %d, expected 3", got)
+	}
+	if got := ts.CountOf(0xFFFF + 1); got != 5 {
+		t.Errorf("CountOf(0xFFFF+1) -> %d, expected 5", got)
+	}
+	if ts.Total() != 8 {
+		t.Errorf("Total() -> %d, expected 8", ts.Total())
+	}
+
+	for _, n := range []int{0, -1, math.MaxUint32 - 7} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("IncrBy(7, %d) with Total() 8 didn't panic", n)
+				}
+			}()
+
+			ts.IncrBy(7, n)
+		}()
+	}
+
+	if ts.Total() != 8 {
+		t.Errorf("Total() -> %d after refused IncrBy, expected 8", ts.Total())
+	}
+}
+
+func TestCountedTokset(t *testing.T) {
+	toks := []token{3, 0xFF, 0x100, 0xFFFF + 1, 0xFFFFFF + 1}
+	counts := []int{2, 1, 5, 3, 4}
+
+	var want tokset
+	for i, tok := range toks {
+		want.IncrBy(tok, counts[i])
+	}
+
+	if got := countedTokset(toks, counts); !reflect.DeepEqual(got, want) {
+		t.Errorf("countedTokset() => %+v, want %+v", got, want)
+	}
+}
+
+func TestChoiceWeighted(t *testing.T) {
+	var ts tokset
+
+	for i := 0; i < 9; i++ {
+		ts.Incr(1)
+	}
+	ts.Incr(2)
+
+	r := &prng{1}
+
+	seen := make(map[token]int)
+	for i := 0; i < 10000; i++ {
+		seen[ts.Choice(r)]++
+	}
+
+	// Token 1 should come up about 90% of the time.
+	if seen[1] < 8500 || seen[1] > 9500 || seen[1]+seen[2] != 10000 {
+		t.Errorf("Choice() frequencies %v, expected about 9000:1000", seen)
+	}
+}
+
+func BenchmarkToksetIncr(b *testing.B) {
+	var ts tokset
+
+	rnd := rand.New(rand.NewSource(0))
+
+	for i := 0; i < b.N; i++ {
+		ts.Incr(token(rnd.Intn(100000)))
+	}
+}
+
+func TestDecr(t *testing.T) {
+	var ts tokset
+
+	adds := []token{7, 0xFF + 1, 7, 0xFFFF + 1, 0xFFFFFF, 0xFFFFFFFF}
+	for _, tok := range adds {
+		ts.Incr(tok)
+	}
+
+	decrs := []token{0xFF + 1, 7, 0xFFFFFF, 0xFFFFFFFF}
+	for _, tok := range decrs {
+		if !ts.Decr(tok) {
+			t.Errorf("Decr(%d) -> false, expected true", tok)
+		}
+	}
+
+	if ts.Decr(42) {
+		t.Errorf("Decr(42) -> true, expected false")
+	}
+
+	expected := []token{7, 0xFFFF + 1}
+	if !reflect.DeepEqual(ts.Tokens(), expected) {
+		t.Fatalf("Decr(%v) -> %v, expected %v", decrs, ts.Tokens(), expected)
+	}
+
+	if ts.CountOf(7) != 1 || ts.CountOf(0xFFFF+1) != 1 || ts.Total() != 2 {
+		t.Errorf("Decr(%v) left counts %d, %d", decrs, ts.CountOf(7), ts.CountOf(0xFFFF+1))
+	}
+
+	ts.Decr(7)
+	ts.Decr(0xFFFF + 1)
+	if ts.Len() != 0 || len(ts.buf) != 0 {
+		t.Errorf("Decr(everything) left %v", ts.buf)
+	}
+}
+
+func TestRemoveLarger(t *testing.T) {
+	var ts tokset
+
+	adds := []token{0xFFFFFF + 1, 1, 0xFFFFFFFF, 0xFFFF + 1, 0xFFFFFF + 2}
+	for _, tok := range adds {
+		ts.Add(tok)
+	}
+
+	for _, tok := range []token{0xFFFFFFFF, 1} {
+		idx, loc, width, ok := ts.find(tok)
+		if !ok {
+			t.Fatalf("find(%d) -> false, expected true", tok)
+		}
+		ts.remove(idx, loc, width)
+	}
+
+	expected := []token{0xFFFF + 1, 0xFFFFFF + 1, 0xFFFFFF + 2}
+	if !reflect.DeepEqual(ts.Tokens(), expected) {
+		t.Errorf("remove -> %v, expected %v", ts.Tokens(), expected)
+	}
+
+	for i, tok := range expected {
+		if got := ts.Index(i); got != tok {
+			t.Errorf("Index(%d) -> %d, expected %d", i, got, tok)
+		}
+	}
+}
+
+// BenchmarkToksetMemory reports the bytes used per token by sets of
+// tokens from a range of ids, to check that small tokens don't pay for
+// large ones.
+func BenchmarkToksetMemory(b *testing.B) {
+	for _, max := range []int64{0xFF, 0xFFFF, 0xFFFFFF, 0xFFFFFFFF} {
+		b.Run(fmt.Sprintf("%x", max), func(b *testing.B) {
+			rnd := rand.New(rand.NewSource(0))
+
+			var bytes, tokens int
+			for i := 0; i < b.N; i++ {
+				var ts tokset
+				for j := 0; j < 100; j++ {
+					ts.Add(token(rnd.Int63n(max + 1)))
+				}
+
+				bytes += int(unsafe.Sizeof(ts)) + len(ts.buf)
+				tokens += ts.Len()
+			}
+
+			b.ReportMetric(float64(bytes)/float64(tokens), "bytes/token")
+		})
+	}
+}